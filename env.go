@@ -1,41 +1,99 @@
 package mito
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"math"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 var defaultEnv = map[any]any{}
 
+// parentScope is the key a scope created by newScope keeps the
+// environment it extends under.
+type parentScope struct{}
+
+// newScope returns an environment with vars that otherwise falls back to
+// env, so that vars can be bound without modifying env.
+func newScope(env map[any]any, vars map[any]any) map[any]any {
+	vars[parentScope{}] = env
+	return vars
+}
+
+// Lookup finds key in env, any environments it extends, or the default
+// environment. Expressions that bind variables, such as let, lambdas and
+// comprehension macros, run their bodies in a new environment that extends
+// the caller's, so ops and modifiers that read other values from the
+// environment must use Lookup rather than indexing it directly.
+func Lookup(env map[any]any, key any) (any, bool) {
+	for env != nil {
+		if v, ok := env[key]; ok {
+			return v, true
+		}
+		env, _ = env[parentScope{}].(map[any]any)
+	}
+	v, ok := defaultEnv[key]
+	return v, ok
+}
+
 func init() {
 	defaultEnv = map[any]any{
-		OpOr: func(env map[any]any, a, b any) (any, error) {
-			x, aok := a.(bool)
-			y, bok := b.(bool)
-			if !aok || !bok {
-				return nil, fmt.Errorf("%w: bool expected: %#v, %#v", ErrTypeMismatch, a, b)
+		// OpOr and OpAnd short-circuit, and like CEL, absorb errors from
+		// either side when the other side alone determines the result, so
+		// error || true is true and false && error is false.
+
+		OpOr: func(env map[any]any, a, b Evaluable) (any, error) {
+			x, errA := runBool(env, a)
+			if errA == nil && x {
+				return true, nil
+			}
+			y, errB := runBool(env, b)
+			if errB == nil && y {
+				return true, nil
+			}
+			if errA != nil {
+				return nil, errA
 			}
-			return x || y, nil
+			if errB != nil {
+				return nil, errB
+			}
+			return false, nil
 		},
 
-		OpAnd: func(env map[any]any, a, b any) (any, error) {
-			x, aok := a.(bool)
-			y, bok := b.(bool)
-			if !aok || !bok {
-				return nil, fmt.Errorf("%w: bool expected: %#v, %#v", ErrTypeMismatch, a, b)
+		OpAnd: func(env map[any]any, a, b Evaluable) (any, error) {
+			x, errA := runBool(env, a)
+			if errA == nil && !x {
+				return false, nil
+			}
+			y, errB := runBool(env, b)
+			if errB == nil && !y {
+				return false, nil
+			}
+			if errA != nil {
+				return nil, errA
 			}
-			return x && y, nil
+			if errB != nil {
+				return nil, errB
+			}
+			return true, nil
 		},
 
 		OpAdd: func(env map[any]any, a, b any) (any, error) {
+			if isList(a) && isList(b) {
+				return concatLists(a, b), nil
+			}
 			switch x := a.(type) {
 			case string:
 				switch y := b.(type) {
 				case string:
 					return x + y, nil
+				case uint64:
+					return x + fmt.Sprint(y), nil
 				case int64:
 					return x + fmt.Sprint(y), nil
 				case float64:
@@ -195,6 +253,15 @@ func init() {
 				default:
 					return nil, fmt.Errorf("%w: unsupported type for addition %T + %T", ErrTypeMismatch, a, b)
 				}
+			case uint64:
+				switch y := b.(type) {
+				case string:
+					return fmt.Sprint(x) + y, nil
+				case uint64:
+					return x + y, nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for addition %T + %T", ErrTypeMismatch, a, b)
+				}
 			default:
 				return nil, fmt.Errorf("%w: unsupported type for addition %T", ErrTypeMismatch, a)
 			}
@@ -301,6 +368,13 @@ func init() {
 				default:
 					return nil, fmt.Errorf("%w: unsupported type for subtraction %T - %T", ErrTypeMismatch, a, b)
 				}
+			case uint64:
+				switch y := b.(type) {
+				case uint64:
+					return x - y, nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for subtraction %T - %T", ErrTypeMismatch, a, b)
+				}
 			default:
 				return nil, fmt.Errorf("%w: unsupported type for subtraction %T", ErrTypeMismatch, a)
 			}
@@ -448,6 +522,13 @@ func init() {
 				default:
 					return nil, fmt.Errorf("%w: unsupported type for multiplication %T * %T", ErrTypeMismatch, a, b)
 				}
+			case uint64:
+				switch y := b.(type) {
+				case uint64:
+					return x * y, nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for multiplication %T * %T", ErrTypeMismatch, a, b)
+				}
 			default:
 				return nil, fmt.Errorf("%w: unsupported type for multiplication %T", ErrTypeMismatch, a)
 			}
@@ -505,13 +586,250 @@ func init() {
 				default:
 					return nil, fmt.Errorf("%w: unsupported type for division %T / %T", ErrTypeMismatch, a, b)
 				}
+			case uint64:
+				switch y := b.(type) {
+				case uint64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return float64(x) / float64(y), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for division %T / %T", ErrTypeMismatch, a, b)
+				}
 			default:
 				return nil, fmt.Errorf("%w: unsupported type for division %T", ErrTypeMismatch, a)
 			}
 		},
 
+		// OpMod and OpFloorDiv round towards negative infinity, so that
+		// a == (a // b) * b + a % b, and the remainder has the sign of b.
+
+		OpMod: func(env map[any]any, a, b any) (any, error) {
+			switch x := a.(type) {
+			case int64:
+				switch y := b.(type) {
+				case int64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return floorModInt(x, y), nil
+				case float64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return floorModFloat(float64(x), y), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for modulo %T %% %T", ErrTypeMismatch, a, b)
+				}
+			case float64:
+				switch y := b.(type) {
+				case int64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return floorModFloat(x, float64(y)), nil
+				case float64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return floorModFloat(x, y), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for modulo %T %% %T", ErrTypeMismatch, a, b)
+				}
+			case time.Duration:
+				switch y := b.(type) {
+				case time.Duration:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return time.Duration(floorModInt(int64(x), int64(y))), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for modulo %T %% %T", ErrTypeMismatch, a, b)
+				}
+			case uint64:
+				switch y := b.(type) {
+				case uint64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return x % y, nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for modulo %T %% %T", ErrTypeMismatch, a, b)
+				}
+			default:
+				return nil, fmt.Errorf("%w: unsupported type for modulo %T", ErrTypeMismatch, a)
+			}
+		},
+
+		OpFloorDiv: func(env map[any]any, a, b any) (any, error) {
+			switch x := a.(type) {
+			case int64:
+				switch y := b.(type) {
+				case int64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return floorDivInt(x, y), nil
+				case float64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return math.Floor(float64(x) / y), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for floor division %T // %T", ErrTypeMismatch, a, b)
+				}
+			case float64:
+				switch y := b.(type) {
+				case int64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return math.Floor(x / float64(y)), nil
+				case float64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return math.Floor(x / y), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for floor division %T // %T", ErrTypeMismatch, a, b)
+				}
+			case time.Duration:
+				switch y := b.(type) {
+				case int64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return time.Duration(floorDivInt(int64(x), y)), nil
+				case float64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return time.Duration(math.Floor(float64(x) / y)), nil
+				case time.Duration:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return floorDivInt(int64(x), int64(y)), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for floor division %T // %T", ErrTypeMismatch, a, b)
+				}
+			case uint64:
+				switch y := b.(type) {
+				case uint64:
+					if y == 0 {
+						return 0, fmt.Errorf("%w: division by zero", ErrValueMismatch)
+					}
+					return x / y, nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for floor division %T // %T", ErrTypeMismatch, a, b)
+				}
+			default:
+				return nil, fmt.Errorf("%w: unsupported type for floor division %T", ErrTypeMismatch, a)
+			}
+		},
+
+		OpShiftLeft: func(env map[any]any, a, b any) (any, error) {
+			y, ok := b.(int64)
+			if !ok {
+				return nil, fmt.Errorf("%w: unsupported type for shift %T << %T", ErrTypeMismatch, a, b)
+			}
+			if y < 0 {
+				return nil, fmt.Errorf("%w: negative shift count", ErrValueMismatch)
+			}
+			switch x := a.(type) {
+			case int64:
+				return x << y, nil
+			case uint64:
+				return x << y, nil
+			default:
+				return nil, fmt.Errorf("%w: unsupported type for shift %T << %T", ErrTypeMismatch, a, b)
+			}
+		},
+
+		OpShiftRight: func(env map[any]any, a, b any) (any, error) {
+			y, ok := b.(int64)
+			if !ok {
+				return nil, fmt.Errorf("%w: unsupported type for shift %T >> %T", ErrTypeMismatch, a, b)
+			}
+			if y < 0 {
+				return nil, fmt.Errorf("%w: negative shift count", ErrValueMismatch)
+			}
+			switch x := a.(type) {
+			case int64:
+				return x >> y, nil
+			case uint64:
+				return x >> y, nil
+			default:
+				return nil, fmt.Errorf("%w: unsupported type for shift %T >> %T", ErrTypeMismatch, a, b)
+			}
+		},
+
+		OpBitAnd: func(env map[any]any, a, b any) (any, error) {
+			switch x := a.(type) {
+			case int64:
+				if y, ok := b.(int64); ok {
+					return x & y, nil
+				}
+			case uint64:
+				if y, ok := b.(uint64); ok {
+					return x & y, nil
+				}
+			case []byte:
+				if y, ok := b.([]byte); ok {
+					if len(x) != len(y) {
+						return nil, fmt.Errorf("%w: mismatched lengths %d & %d", ErrValueMismatch, len(x), len(y))
+					}
+					rv := make([]byte, len(x))
+					for i := range x {
+						rv[i] = x[i] & y[i]
+					}
+					return rv, nil
+				}
+			}
+			return nil, fmt.Errorf("%w: unsupported type for bitwise and %T & %T", ErrTypeMismatch, a, b)
+		},
+
+		OpBitOr: func(env map[any]any, a, b any) (any, error) {
+			switch x := a.(type) {
+			case int64:
+				if y, ok := b.(int64); ok {
+					return x | y, nil
+				}
+			case uint64:
+				if y, ok := b.(uint64); ok {
+					return x | y, nil
+				}
+			case []byte:
+				if y, ok := b.([]byte); ok {
+					if len(x) != len(y) {
+						return nil, fmt.Errorf("%w: mismatched lengths %d | %d", ErrValueMismatch, len(x), len(y))
+					}
+					rv := make([]byte, len(x))
+					for i := range x {
+						rv[i] = x[i] | y[i]
+					}
+					return rv, nil
+				}
+			}
+			return nil, fmt.Errorf("%w: unsupported type for bitwise or %T | %T", ErrTypeMismatch, a, b)
+		},
+
+		OpBitXor: func(env map[any]any, a, b any) (any, error) {
+			switch x := a.(type) {
+			case int64:
+				if y, ok := b.(int64); ok {
+					return x ^ y, nil
+				}
+			case uint64:
+				if y, ok := b.(uint64); ok {
+					return x ^ y, nil
+				}
+			}
+			return nil, fmt.Errorf("%w: unsupported type for bitwise xor %T xor %T", ErrTypeMismatch, a, b)
+		},
+
 		// type order:
-		//  bool/int64/float64/time.Duration, time.Time, string/[]byte
+		//  bool/int64/uint64/float64/time.Duration, time.Time, string/[]byte
 
 		OpLess: func(env map[any]any, a, b any) (any, error) {
 			switch x := a.(type) {
@@ -519,7 +837,7 @@ func init() {
 				switch y := b.(type) {
 				case string:
 					return x < y, nil
-				case int64, bool, float64, time.Duration, time.Time:
+				case int64, uint64, bool, float64, time.Duration, time.Time:
 					return false, nil
 				case []byte:
 					return x < string(y), nil
@@ -532,6 +850,8 @@ func init() {
 					return true, nil
 				case int64:
 					return x < y, nil
+				case uint64:
+					return x < 0 || uint64(x) < y, nil
 				case float64:
 					return float64(x) < y, nil
 				case bool:
@@ -550,6 +870,8 @@ func init() {
 					return true, nil
 				case int64:
 					return x < float64(y), nil
+				case uint64:
+					return x < float64(y), nil
 				case float64:
 					return x < y, nil
 				case bool:
@@ -566,7 +888,7 @@ func init() {
 				switch y := b.(type) {
 				case string:
 					return string(x) < y, nil
-				case int64, float64, time.Duration, bool, time.Time:
+				case int64, uint64, float64, time.Duration, bool, time.Time:
 					return false, nil
 				case []byte:
 					return string(x) < string(y), nil
@@ -582,6 +904,11 @@ func init() {
 						return 1 < y, nil
 					}
 					return 0 < y, nil
+				case uint64:
+					if x {
+						return 1 < y, nil
+					}
+					return 0 < y, nil
 				case float64:
 					if x {
 						return 1 < y, nil
@@ -597,6 +924,24 @@ func init() {
 				default:
 					return nil, fmt.Errorf("%w: unsupported type for comparison %T < %T", ErrTypeMismatch, a, b)
 				}
+			case uint64:
+				switch y := b.(type) {
+				case string, time.Time, []byte:
+					return true, nil
+				case int64:
+					return y >= 0 && x < uint64(y), nil
+				case uint64:
+					return x < y, nil
+				case float64:
+					return float64(x) < y, nil
+				case bool:
+					if y {
+						return x < 1, nil
+					}
+					return false, nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for comparison %T < %T", ErrTypeMismatch, a, b)
+				}
 			case time.Duration:
 				switch y := b.(type) {
 				case string, []byte, time.Time:
@@ -619,7 +964,7 @@ func init() {
 				switch y := b.(type) {
 				case string, []byte:
 					return false, nil
-				case int64, bool, float64, time.Duration:
+				case int64, uint64, bool, float64, time.Duration:
 					return true, nil
 				case time.Time:
 					return x.Before(y), nil
@@ -644,6 +989,18 @@ func init() {
 		},
 
 		OpEqual: func(env map[any]any, a, b any) (any, error) {
+			if isNil(a) || isNil(b) {
+				return isNil(a) && isNil(b), nil
+			}
+			if isList(a) || isList(b) {
+				return listEqual(env, a, b)
+			}
+			if isMap(a) || isMap(b) {
+				return mapEqual(env, a, b)
+			}
+			if isRange(a) || isRange(b) {
+				return rangeEqual(env, a, b)
+			}
 			less, err := lessHelper(env, a, b)
 			if err != nil {
 				return nil, err
@@ -656,6 +1013,21 @@ func init() {
 		},
 
 		OpNotEqual: func(env map[any]any, a, b any) (any, error) {
+			if isNil(a) || isNil(b) {
+				return !isNil(a) || !isNil(b), nil
+			}
+			if isList(a) || isList(b) {
+				eq, err := listEqual(env, a, b)
+				return !eq, err
+			}
+			if isMap(a) || isMap(b) {
+				eq, err := mapEqual(env, a, b)
+				return !eq, err
+			}
+			if isRange(a) || isRange(b) {
+				eq, err := rangeEqual(env, a, b)
+				return !eq, err
+			}
 			less, err := lessHelper(env, a, b)
 			if err != nil {
 				return nil, err
@@ -684,6 +1056,61 @@ func init() {
 			return !less, err
 		},
 
+		OpRange: func(env map[any]any, a, b any) (any, error) {
+			return newRange(a, b, false)
+		},
+
+		OpRangeExclusive: func(env map[any]any, a, b any) (any, error) {
+			return newRange(a, b, true)
+		},
+
+		OpIn: func(env map[any]any, a, b any) (any, error) {
+			switch y := b.(type) {
+			case Range:
+				return y.contains(env, a)
+			case string:
+				switch x := a.(type) {
+				case string:
+					return strings.Contains(y, x), nil
+				case []byte:
+					return strings.Contains(y, string(x)), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for membership %T in %T", ErrTypeMismatch, a, b)
+				}
+			case []byte:
+				switch x := a.(type) {
+				case string:
+					return bytes.Contains(y, []byte(x)), nil
+				case []byte:
+					return bytes.Contains(y, x), nil
+				default:
+					return nil, fmt.Errorf("%w: unsupported type for membership %T in %T", ErrTypeMismatch, a, b)
+				}
+			}
+			if isList(b) {
+				y := reflect.ValueOf(b)
+				for i := 0; i < y.Len(); i++ {
+					eq, err := equalHelper(env, a, fromGo(y.Index(i)))
+					if err != nil {
+						return nil, err
+					}
+					if eq {
+						return true, nil
+					}
+				}
+				return false, nil
+			}
+			if isMap(b) {
+				y := reflect.ValueOf(b)
+				key, err := convertKey(reflect.ValueOf(a), y.Type().Key())
+				if err != nil {
+					return false, nil
+				}
+				return y.MapIndex(key).IsValid(), nil
+			}
+			return nil, fmt.Errorf("%w: unsupported type for membership %T in %T", ErrTypeMismatch, a, b)
+		},
+
 		OpExp: func(env map[any]any, a, b any) (any, error) {
 			switch x := a.(type) {
 			case int64:
@@ -763,16 +1190,233 @@ func init() {
 
 		},
 
+		ModBitNot: func(env map[any]any, a any) (any, error) {
+			switch x := a.(type) {
+			case int64:
+				return ^x, nil
+			case uint64:
+				return ^x, nil
+			default:
+				return nil, fmt.Errorf("%w: unsupported type for bitwise not %T", ErrTypeMismatch, a)
+			}
+		},
+
+		// OpCoalesce only evaluates its right side if its left side is null.
+		OpCoalesce: func(env map[any]any, a, b Evaluable) (any, error) {
+			x, err := a.Run(env)
+			if err != nil || !isNil(x) {
+				return x, err
+			}
+			return b.Run(env)
+		},
+
+		// Patterns for OpMatch, OpNotMatch and matches are RE2 syntax, and
+		// can be strings or *regexp.Regexps. Constant patterns for OpMatch
+		// and OpNotMatch are compiled by the parser, and other string
+		// patterns are compiled once and cached.
+
+		OpMatch: func(env map[any]any, a, b Evaluable) (any, error) {
+			return matchOperands(env, a, b)
+		},
+
+		OpNotMatch: func(env map[any]any, a, b Evaluable) (any, error) {
+			matched, err := matchOperands(env, a, b)
+			return !matched, err
+		},
+
+		"matches": matchPattern,
+
+		ModFormat: func(env map[any]any, a any) (any, error) {
+			switch x := a.(type) {
+			case string:
+				return x, nil
+			case nil:
+				return "null", nil
+			case time.Time:
+				return x.Format(time.RFC3339Nano), nil
+			default:
+				return fmt.Sprint(x), nil
+			}
+		},
+
 		"true":  true,
 		"false": false,
+		"null":  nil,
+
+		"timestamp": func(s string) (time.Time, error) {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("%w: %v", ErrValueMismatch, err)
+			}
+			return t, nil
+		},
+
+		"date": func(year, month, day int64) (time.Time, error) {
+			t := time.Date(int(year), time.Month(month), int(day), 0, 0, 0, 0, time.UTC)
+			if int64(t.Year()) != year || int64(t.Month()) != month || int64(t.Day()) != day {
+				return time.Time{}, fmt.Errorf("%w: invalid date %d-%d-%d", ErrValueMismatch, year, month, day)
+			}
+			return t, nil
+		},
+
+		"duration": func(s string) (time.Duration, error) {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return 0, fmt.Errorf("%w: %v", ErrValueMismatch, err)
+			}
+			return d, nil
+		},
 	}
 }
 
-func lessHelper(env map[any]any, a, b any) (bool, error) {
-	lessUncasted, ok := env[OpLess]
+// regexpCacheSize bounds how many dynamic patterns are kept compiled.
+const regexpCacheSize = 128
+
+var regexpCache = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: map[string]*regexp.Regexp{}}
+
+// cachedRegexp compiles pattern, reusing a previous compilation if there
+// is one in the cache.
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.Lock()
+	defer regexpCache.Unlock()
+	if re, ok := regexpCache.compiled[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid pattern %#v: %v", ErrValueMismatch, pattern, err)
+	}
+	if len(regexpCache.compiled) >= regexpCacheSize {
+		for evict := range regexpCache.compiled {
+			delete(regexpCache.compiled, evict)
+			break
+		}
+	}
+	regexpCache.compiled[pattern] = re
+	return re, nil
+}
+
+// matchOperands evaluates s and pattern and returns whether s matches
+// pattern, using the compiled regexp of constant patterns.
+func matchOperands(env map[any]any, s, pattern Evaluable) (bool, error) {
+	x, err := s.Run(env)
+	if err != nil {
+		return false, err
+	}
+	if p, ok := pattern.(*Pattern); ok {
+		return matchPattern(x, p.Regexp)
+	}
+	y, err := pattern.Run(env)
+	if err != nil {
+		return false, err
+	}
+	return matchPattern(x, y)
+}
+
+// matchPattern returns whether the string s contains a match of pattern.
+func matchPattern(s, pattern any) (bool, error) {
+	str, ok := s.(string)
+	if !ok {
+		return false, fmt.Errorf("%w: unsupported type for match %T", ErrTypeMismatch, s)
+	}
+	switch pattern := pattern.(type) {
+	case *regexp.Regexp:
+		return pattern.MatchString(str), nil
+	case string:
+		re, err := cachedRegexp(pattern)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(str), nil
+	}
+	return false, fmt.Errorf("%w: unsupported type for pattern %T", ErrTypeMismatch, pattern)
+}
+
+// Range is the value of a range like 1..10, which includes End, or
+// 1..<10, which has Exclusive set and doesn't. Start and End are both
+// int64s, float64s, time.Durations or time.Times. Ranges of int64s can be
+// iterated over by comprehensions.
+type Range struct {
+	Start, End any
+	Exclusive  bool
+}
+
+func newRange(a, b any, exclusive bool) (Range, error) {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(float64); ok {
+			a = float64(x)
+			b = y
+		}
+	case float64:
+		if y, ok := b.(int64); ok {
+			b = float64(y)
+		}
+	}
+	if rangeClass(a) == "" || reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return Range{}, fmt.Errorf("%w: unsupported types for range %T..%T", ErrTypeMismatch, a, b)
+	}
+	return Range{Start: a, End: b, Exclusive: exclusive}, nil
+}
+
+// rangeClass groups the types that can be compared with a range's bounds.
+func rangeClass(a any) string {
+	switch a.(type) {
+	case int64, uint64, float64:
+		return "number"
+	case time.Duration:
+		return "duration"
+	case time.Time:
+		return "time"
+	}
+	return ""
+}
+
+func isRange(a any) bool {
+	_, ok := a.(Range)
+	return ok
+}
+
+// rangeEqual compares two ranges by their bounds, using the environment's
+// equality. Comparing a range with a non-range is always false.
+func rangeEqual(env map[any]any, a, b any) (bool, error) {
+	x, ok := a.(Range)
 	if !ok {
-		lessUncasted, ok = defaultEnv[OpLess]
+		return false, nil
+	}
+	y, ok := b.(Range)
+	if !ok || x.Exclusive != y.Exclusive {
+		return false, nil
+	}
+	eq, err := equalHelper(env, x.Start, y.Start)
+	if err != nil || !eq {
+		return false, err
 	}
+	return equalHelper(env, x.End, y.End)
+}
+
+// contains returns whether x is within r, using the environment's
+// comparison.
+func (r Range) contains(env map[any]any, x any) (bool, error) {
+	if rangeClass(x) == "" || rangeClass(x) != rangeClass(r.Start) {
+		return false, fmt.Errorf("%w: unsupported type for membership %T in range of %T", ErrTypeMismatch, x, r.Start)
+	}
+	below, err := lessHelper(env, x, r.Start)
+	if err != nil || below {
+		return false, err
+	}
+	if r.Exclusive {
+		return lessHelper(env, x, r.End)
+	}
+	above, err := lessHelper(env, r.End, x)
+	return !above, err
+}
+
+func lessHelper(env map[any]any, a, b any) (bool, error) {
+	lessUncasted, ok := Lookup(env, OpLess)
 	if !ok {
 		return false, fmt.Errorf("environment doesn't define less")
 	}
@@ -789,3 +1433,135 @@ func lessHelper(env map[any]any, a, b any) (bool, error) {
 	}
 	return false, fmt.Errorf("less doesn't return bool")
 }
+
+func equalHelper(env map[any]any, a, b any) (bool, error) {
+	equalUncasted, ok := Lookup(env, OpEqual)
+	if !ok {
+		return false, fmt.Errorf("environment doesn't define equal")
+	}
+	equal, ok := equalUncasted.(func(env map[any]any, a, b any) (any, error))
+	if !ok {
+		return false, fmt.Errorf("environment defines equal wrong")
+	}
+	res, err := equal(env, a, b)
+	if err != nil {
+		return false, err
+	}
+	if res, ok := res.(bool); ok {
+		return res, nil
+	}
+	return false, fmt.Errorf("equal doesn't return bool")
+}
+
+// isList returns true for []any and any other slice or array, other than
+// []byte, which is treated as a scalar.
+func isList(a any) bool {
+	if _, ok := a.([]byte); ok {
+		return false
+	}
+	switch reflect.ValueOf(a).Kind() {
+	case reflect.Slice, reflect.Array:
+		return true
+	}
+	return false
+}
+
+// concatLists returns the elements of a followed by the elements of b.
+func concatLists(a, b any) []any {
+	x, y := reflect.ValueOf(a), reflect.ValueOf(b)
+	rv := make([]any, 0, x.Len()+y.Len())
+	for i := 0; i < x.Len(); i++ {
+		rv = append(rv, fromGo(x.Index(i)))
+	}
+	for i := 0; i < y.Len(); i++ {
+		rv = append(rv, fromGo(y.Index(i)))
+	}
+	return rv
+}
+
+// listEqual compares two lists element-wise using the environment's
+// equality. Comparing a list with a non-list is always false.
+func listEqual(env map[any]any, a, b any) (bool, error) {
+	if !isList(a) || !isList(b) {
+		return false, nil
+	}
+	x, y := reflect.ValueOf(a), reflect.ValueOf(b)
+	if x.Len() != y.Len() {
+		return false, nil
+	}
+	for i := 0; i < x.Len(); i++ {
+		eq, err := equalHelper(env, fromGo(x.Index(i)), fromGo(y.Index(i)))
+		if err != nil || !eq {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func isMap(a any) bool {
+	return reflect.ValueOf(a).Kind() == reflect.Map
+}
+
+// mapEqual compares two maps by keys and, using the environment's
+// equality, values. Comparing a map with a non-map is always false.
+func mapEqual(env map[any]any, a, b any) (bool, error) {
+	if !isMap(a) || !isMap(b) {
+		return false, nil
+	}
+	x, y := reflect.ValueOf(a), reflect.ValueOf(b)
+	if x.Len() != y.Len() {
+		return false, nil
+	}
+	iter := x.MapRange()
+	for iter.Next() {
+		key, err := convertKey(reflect.ValueOf(iter.Key().Interface()), y.Type().Key())
+		if err != nil {
+			return false, nil
+		}
+		yval := y.MapIndex(key)
+		if !yval.IsValid() {
+			return false, nil
+		}
+		eq, err := equalHelper(env, fromGo(iter.Value()), fromGo(yval))
+		if err != nil || !eq {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func floorDivInt(x, y int64) int64 {
+	q := x / y
+	if x%y != 0 && (x < 0) != (y < 0) {
+		q--
+	}
+	return q
+}
+
+func floorModInt(x, y int64) int64 {
+	r := x % y
+	if r != 0 && (r < 0) != (y < 0) {
+		r += y
+	}
+	return r
+}
+
+func floorModFloat(x, y float64) float64 {
+	r := math.Mod(x, y)
+	if r != 0 && (r < 0) != (y < 0) {
+		r += y
+	}
+	return r
+}
+
+func runBool(env map[any]any, e Evaluable) (bool, error) {
+	val, err := e.Run(env)
+	if err != nil {
+		return false, err
+	}
+	x, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("%w: bool expected: %#v", ErrTypeMismatch, val)
+	}
+	return x, nil
+}
@@ -1,17 +1,22 @@
-// Package mito is an attempt at making CEL (the 
+// Package mito is an attempt at making CEL (the
 // "common expression language"), but much more
 // simply. instead of using protobufs it lets you
 // use your own types, kind of like userdata in lua.
 package mito
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
@@ -21,6 +26,10 @@ var (
 	ErrInvalidOp     = errors.New("invalid op")
 	ErrTypeMismatch  = errors.New("type mismatch")
 	ErrValueMismatch = errors.New("value mismatch")
+	ErrUnknownField  = errors.New("unknown field")
+
+	ErrIndexOutOfRange = fmt.Errorf("%w: index out of range", ErrValueMismatch)
+	ErrMissingKey      = fmt.Errorf("%w: missing key", ErrValueMismatch)
 )
 
 func setToMap(chars string) map[rune]bool {
@@ -38,14 +47,48 @@ type Evaluable interface {
 var (
 	identChars                   = setToMap("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_0123456789")
 	disallowedStartingIdentChars = setToMap("0123456789.")
-	numberChars                  = setToMap("0123456789_.")
-	durationSuffixes             = []string{"ns", "us", "µs", "ms", "s", "m", "h"}
+	decimalDigits                = setToMap("0123456789_")
+	numberPrefixes               = map[rune]map[rune]bool{
+		'x': setToMap("0123456789abcdefABCDEF_"),
+		'b': setToMap("01_"),
+		'o': setToMap("01234567_"),
+	}
+	durationSuffixes         = []string{"ns", "us", "µs", "ms", "s", "m", "h"}
+	extendedDurationSuffixes = map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	simpleEscapes            = map[rune]byte{
+		'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v',
+		'\\': '\\', '\'': '\'', '"': '"', '`': '`', '?': '?',
+	}
+	keywords = map[string]bool{"if": true, "then": true, "else": true, "in": true, "let": true, "match": true, "case": true}
+	macros   = map[string]bool{"all": true, "exists": true, "exists_one": true, "map": true, "filter": true}
 )
 
 type Parser struct {
 	source         []rune
 	pos, line, col int
 	currentChar    rune
+
+	// noIn is set while parsing let bindings, where in ends the bindings
+	// instead of being an operator.
+	noIn bool
+
+	// noLambda is set while parsing match patterns, where => ends the
+	// pattern instead of starting a lambda body.
+	noLambda bool
+
+	// embeddedQuote is the quote of the interpolated string an expression
+	// is embedded in, if any. Comments aren't allowed there, since they
+	// would hide the end of the string, and neither are newlines if the
+	// string is a single line one.
+	embeddedQuote string
+
+	// ExtendedDurations enables the d and w duration units, which are
+	// always exactly 24 hours and 7 days, regardless of calendars.
+	ExtendedDurations bool
+
+	// Warnings collects problems found while parsing that don't stop the
+	// expression from running, such as a match without a default arm.
+	Warnings []string
 }
 
 func NewParser(source string) *Parser {
@@ -149,6 +192,11 @@ func (p *Parser) skipWhitespace() (bool, error) {
 	if p.eof() {
 		return false, nil
 	}
+	if p.embeddedQuote != "" {
+		if p.currentChar == '#' || p.currentChar == '\n' && len(p.embeddedQuote) == 1 {
+			return false, nil
+		}
+	}
 	skipped, err := p.skipComment()
 	if err != nil {
 		return false, err
@@ -181,10 +229,15 @@ func (p *Parser) parseIdentifier() (Evaluable, error) {
 	if disallowedStartingIdentChars[p.currentChar] {
 		return nil, nil
 	}
+	cpos, ccol, cline := p.checkpoint()
 	chars, err := p.parseChars(identChars)
 	if err != nil {
 		return nil, err
 	}
+	if keywords[chars] {
+		p.restore(cpos, ccol, cline)
+		return nil, nil
+	}
 	if _, err = p.skipAllWhitespace(); err != nil {
 		return nil, err
 	}
@@ -200,47 +253,202 @@ func (p *Parser) parseDurationSuffix() (string, error) {
 			return suffix, p.advance(len(suffix))
 		}
 	}
+	if p.ExtendedDurations {
+		if _, ok := extendedDurationSuffixes[p.string(1)]; ok {
+			suffix := p.string(1)
+			return suffix, p.advance(1)
+		}
+	}
 	return "", nil
 }
 
-func (p *Parser) parseValue() (Evaluable, error) {
-	num, err := p.parseChars(numberChars)
-	if err != nil {
-		return nil, err
+// durationPart is one number and unit of a duration literal like 1h30m.
+type durationPart struct {
+	num, unit string
+}
+
+func sumDuration(parts []durationPart) (time.Duration, error) {
+	var total time.Duration
+	for _, part := range parts {
+		var dur time.Duration
+		if unit, ok := extendedDurationSuffixes[part.unit]; ok {
+			f, err := strconv.ParseFloat(part.num, 64)
+			if err != nil {
+				return 0, errors.Unwrap(err)
+			}
+			f *= float64(unit)
+			if f >= math.MaxInt64 {
+				return 0, errors.New("duration out of range")
+			}
+			dur = time.Duration(f)
+		} else {
+			var err error
+			dur, err = time.ParseDuration(part.num + part.unit)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if total > math.MaxInt64-dur {
+			return 0, errors.New("duration out of range")
+		}
+		total += dur
 	}
+	return total, nil
+}
 
-	suffix, err := p.parseDurationSuffix()
-	if err != nil {
-		return nil, err
+func (p *Parser) parseValue() (Evaluable, error) {
+	if !isDigit(p.char(0)) && !(p.char(0) == '.' && isDigit(p.char(1))) {
+		return nil, nil
+	}
+	cpos, ccol, cline := p.checkpoint()
+	malformed := func(messagef string, args ...any) error {
+		num := string(p.source[cpos:p.pos])
+		p.restore(cpos, ccol, cline)
+		return p.sourceError("malformed number %#v: %s", num, fmt.Sprintf(messagef, args...))
 	}
 
-	if _, err = p.skipAllWhitespace(); err != nil {
+	num, isFloat, isDecimal, err := p.parseNumber()
+	if err != nil {
 		return nil, err
 	}
-	if num == "" {
-		return nil, nil
+	if strings.HasSuffix(num, "_") || strings.Contains(num, "__") {
+		return nil, malformed("misplaced underscore")
 	}
 
-	if suffix != "" {
-		dur, err := time.ParseDuration(num + suffix)
+	var suffix string
+	if isDecimal && !strings.ContainsAny(num, "eE") {
+		suffix, err = p.parseDurationSuffix()
 		if err != nil {
 			return nil, err
 		}
-		return &Value[time.Duration]{Val: dur}, nil
 	}
-
-	if strings.Contains(num, ".") {
-		val, err := strconv.ParseFloat(num, 64)
+	durationParts := []durationPart{{num: num, unit: suffix}}
+	for suffix != "" && (isDigit(p.char(0)) || p.char(0) == '.' && isDigit(p.char(1))) {
+		part, isFloat, isDecimal, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		if isFloat && strings.ContainsAny(part, "eE") || !isDecimal {
+			return nil, malformed("invalid duration")
+		}
+		unit, err := p.parseDurationSuffix()
 		if err != nil {
 			return nil, err
 		}
-		return &Value[float64]{Val: val}, nil
+		if unit == "" {
+			return nil, malformed("missing duration unit")
+		}
+		durationParts = append(durationParts, durationPart{num: part, unit: unit})
+	}
+	unsigned := false
+	if suffix == "" && !isFloat && (p.char(0) == 'u' || p.char(0) == 'U') {
+		unsigned = true
+		if err = p.advance(1); err != nil {
+			return nil, err
+		}
+	}
+	if identChars[p.char(0)] || p.char(0) == '.' && isDigit(p.char(1)) {
+		if err = p.advance(1); err != nil {
+			return nil, err
+		}
+		return nil, malformed("unexpected character %#v", p.char(-1))
+	}
+
+	var val Evaluable
+	switch {
+	case suffix != "":
+		dur, err := sumDuration(durationParts)
+		if err != nil {
+			return nil, malformed("%v", err)
+		}
+		val = &Value[time.Duration]{Val: dur}
+	case isFloat:
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, malformed("%v", errors.Unwrap(err))
+		}
+		val = &Value[float64]{Val: f}
+	case unsigned:
+		u, err := strconv.ParseUint(num, 0, 64)
+		if err != nil {
+			return nil, malformed("%v", errors.Unwrap(err))
+		}
+		val = &Value[uint64]{Val: u}
+	default:
+		i, err := strconv.ParseInt(num, 0, 64)
+		if err != nil {
+			return nil, malformed("%v", errors.Unwrap(err))
+		}
+		val = &Value[int64]{Val: i}
+	}
+
+	_, err = p.skipAllWhitespace()
+	return val, err
+}
+
+func isDigit(char rune) bool {
+	return char >= '0' && char <= '9'
+}
+
+// parseNumber consumes the digits of a number literal: an integer with
+// an optional 0x, 0b or 0o prefix, or a decimal with an optional fraction
+// and exponent. isDecimal is false if there was a prefix.
+func (p *Parser) parseNumber() (num string, isFloat, isDecimal bool, err error) {
+	if p.char(0) == '0' {
+		if digits, ok := numberPrefixes[unicode.ToLower(p.char(1))]; ok {
+			prefix := p.string(2)
+			if err := p.advance(2); err != nil {
+				return "", false, false, err
+			}
+			if p.char(0) == '_' {
+				prefix += "_"
+				if err := p.advance(1); err != nil {
+					return "", false, false, err
+				}
+			}
+			num, err := p.parseChars(digits)
+			if err != nil {
+				return "", false, false, err
+			}
+			if num == "" {
+				return "", false, false, p.sourceError("malformed number %#v: missing digits", prefix)
+			}
+			return prefix + num, false, false, nil
+		}
 	}
-	val, err := strconv.ParseInt(num, 0, 64)
+
+	num, err = p.parseChars(decimalDigits)
 	if err != nil {
-		return nil, err
+		return "", false, false, err
+	}
+	if p.char(0) == '.' && isDigit(p.char(1)) {
+		if err := p.advance(1); err != nil {
+			return "", false, false, err
+		}
+		frac, err := p.parseChars(decimalDigits)
+		if err != nil {
+			return "", false, false, err
+		}
+		num, isFloat = num+"."+frac, true
+	}
+	if p.char(0) == 'e' || p.char(0) == 'E' {
+		sign := 1
+		if p.char(1) == '+' || p.char(1) == '-' {
+			sign = 2
+		}
+		if isDigit(p.char(sign)) {
+			exp := p.string(sign)
+			if err := p.advance(sign); err != nil {
+				return "", false, false, err
+			}
+			digits, err := p.parseChars(decimalDigits)
+			if err != nil {
+				return "", false, false, err
+			}
+			num, isFloat = num+exp+digits, true
+		}
 	}
-	return &Value[int64]{Val: val}, nil
+	return num, isFloat, true, nil
 }
 
 func (p *Parser) parseChars(allowed map[rune]bool) (string, error) {
@@ -260,347 +468,1514 @@ func (p *Parser) parseChars(allowed map[rune]bool) (string, error) {
 	return chars, nil
 }
 
+// parseString parses a string or bytes literal. Strings can be quoted
+// with " or ', or with three of either to span multiple lines. An r or R
+// prefix, or quoting with `, makes a raw string, where backslashes have no
+// special meaning. A b or B prefix makes a []byte instead of a string, and can be
+// combined with r. An x or X prefix makes a []byte from hex digits, and a
+// t prefix makes a time.Time from an RFC 3339 timestamp.
 func (p *Parser) parseString() (Evaluable, error) {
-	if p.char(0) != '"' {
-		return nil, nil
-	}
-	if err := p.advance(1); err != nil {
-		return nil, err
-	}
-	var val []rune
-	for {
-		r := p.char(0)
-		if err := p.advance(1); err != nil {
-			return nil, err
-		}
-		switch r {
-		case '\\':
-			r = p.char(0)
-			if err := p.advance(1); err != nil {
-				return nil, err
+	if (p.char(0) == 'x' || p.char(0) == 'X') && (p.char(1) == '"' || p.char(1) == '\'') {
+		return p.parseHexBytes()
+	}
+	if p.char(0) == 't' && (p.char(1) == '"' || p.char(1) == '\'') {
+		return p.parseTimestamp()
+	}
+	if p.char(0) == 'f' && (p.char(1) == '"' || p.char(1) == '\'') {
+		return p.parseInterpolation()
+	}
+	var raw, bytes bool
+	prefix := 0
+prefixes:
+	for ; prefix < 2; prefix++ {
+		switch p.char(prefix) {
+		case 'r', 'R':
+			if raw {
+				return nil, nil
 			}
-			switch r {
-			case '\\', '"':
-				val = append(val, r)
-			case 'n':
-				val = append(val, '\n')
-			case 't':
-				val = append(val, '\t')
-			default:
-				return nil, p.sourceError("unexpected escape code: %#v", r)
-			}
-		case '"':
-			_, err := p.skipAllWhitespace()
-			return &Value[string]{Val: string(val)}, err
-		case '\n':
-			return nil, p.sourceError("unexpected end of line")
+			raw = true
+		case 'b', 'B':
+			if bytes {
+				return nil, nil
+			}
+			bytes = true
 		default:
-			val = append(val, r)
+			break prefixes
+		}
+	}
+	if prefix > 0 {
+		if p.char(prefix) != '"' && p.char(prefix) != '\'' {
+			return nil, nil
+		}
+		if err := p.advance(prefix); err != nil {
+			return nil, err
 		}
 	}
+	val, err := p.parseQuoted(raw, bytes)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	if bytes {
+		return &Value[[]byte]{Val: val}, nil
+	}
+	return &Value[string]{Val: string(val)}, nil
 }
 
-func (p *Parser) parseLiteral() (Evaluable, error) {
-	str, err := p.parseString()
+func (p *Parser) parseTimestamp() (Evaluable, error) {
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	cpos, ccol, cline := p.checkpoint()
+	text, err := p.parseQuoted(true, false)
 	if err != nil {
 		return nil, err
 	}
-	if str != nil {
-		return str, nil
+	val, err := time.Parse(time.RFC3339Nano, string(text))
+	if err != nil {
+		p.restore(cpos, ccol, cline)
+		return nil, p.sourceError("invalid timestamp %#v: %v", string(text), err)
 	}
-	ident, err := p.parseIdentifier()
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	return &Value[time.Time]{Val: val}, nil
+}
+
+func (p *Parser) parseHexBytes() (Evaluable, error) {
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	cpos, ccol, cline := p.checkpoint()
+	digits, err := p.parseQuoted(true, false)
 	if err != nil {
 		return nil, err
 	}
-	if ident != nil {
-		return ident, nil
+	val, err := hex.DecodeString(string(digits))
+	if err != nil {
+		p.restore(cpos, ccol, cline)
+		return nil, p.sourceError("invalid hex bytes %#v: %v", string(digits), err)
 	}
-	return p.parseValue()
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	return &Value[[]byte]{Val: val}, nil
 }
 
-func (p *Parser) parseFunctionCall() (Evaluable, error) {
-	val, err := p.parseLiteral()
-	if err != nil {
+// parseInterpolation parses an interpolated string like f"{n} items",
+// where each expression in braces is formatted with ModFormat. {{ and }}
+// are literal braces, so an embedded map literal needs a space, as in
+// f"{ {"k": 1}.k }".
+func (p *Parser) parseInterpolation() (Evaluable, error) {
+	if err := p.advance(1); err != nil {
 		return nil, err
 	}
-	if val == nil {
-		return nil, nil
+	quote := string(p.char(0))
+	if p.string(3) == strings.Repeat(quote, 3) {
+		quote = strings.Repeat(quote, 3)
+	}
+	if err := p.advance(len(quote)); err != nil {
+		return nil, err
 	}
+	interp := &Interpolation{}
+	text := []byte{}
 	for {
 		if p.eof() {
-			return val, nil
+			return nil, p.sourceError("unterminated string")
 		}
-		args, err := p.parseArgs()
-		if err != nil {
-			return nil, err
+		if p.string(len(quote)) == quote {
+			break
 		}
-		if args == nil {
-			_, err = p.skipAllWhitespace()
-			return val, err
+		switch r := p.char(0); {
+		case r == '\n' && len(quote) == 1:
+			return nil, p.sourceError("unexpected end of line")
+		case r == '\\':
+			escaped, err := p.parseEscape(false)
+			if err != nil {
+				return nil, err
+			}
+			text = append(text, escaped...)
+			continue
+		case p.string(2) == "{{" || p.string(2) == "}}":
+			text = append(text, byte(r))
+			if err := p.advance(2); err != nil {
+				return nil, err
+			}
+			continue
+		case r == '}':
+			return nil, p.sourceError("unmatched '}' in interpolated string")
+		case r == '{':
+			if len(text) > 0 {
+				interp.Parts = append(interp.Parts, &Value[string]{Val: string(text)})
+				text = []byte{}
+			}
+			expr, err := p.parseEmbedded(quote)
+			if err != nil {
+				return nil, err
+			}
+			interp.Parts = append(interp.Parts, &Modifier{Type: ModFormat, Val: expr})
+			continue
+		default:
+			text = utf8.AppendRune(text, r)
 		}
-		val = &Call{
-			Func: val,
-			Args: args,
+		if err := p.advance(1); err != nil {
+			return nil, err
 		}
 	}
+	if len(text) > 0 || len(interp.Parts) == 0 {
+		interp.Parts = append(interp.Parts, &Value[string]{Val: string(text)})
+	}
+	if err := p.advance(len(quote)); err != nil {
+		return nil, err
+	}
+	_, err := p.skipAllWhitespace()
+	return interp, err
 }
 
-func (p *Parser) parseArgs() ([]Evaluable, error) {
-	if p.char(0) != '(' {
-		return nil, nil
-	}
+// parseEmbedded parses a braced expression inside an interpolated string
+// quoted with quote.
+func (p *Parser) parseEmbedded(quote string) (Evaluable, error) {
+	embeddedQuote := p.embeddedQuote
+	p.embeddedQuote = quote
+	defer func() { p.embeddedQuote = embeddedQuote }()
 	if err := p.advance(1); err != nil {
 		return nil, err
 	}
 	if _, err := p.skipAllWhitespace(); err != nil {
 		return nil, err
 	}
-	args := []Evaluable{}
-	if p.char(0) == ')' {
-		if err := p.advance(1); err != nil {
-			return nil, err
-		}
-		return args, nil
-	}
-	arg, err := p.parseExpression()
+	expr, err := p.parseNestedExpression()
 	if err != nil {
 		return nil, err
 	}
-	if arg == nil {
-		return nil, p.sourceError("unexpected missing argument")
+	if expr == nil {
+		return nil, p.sourceError("missing expression in interpolated string")
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	switch p.char(0) {
+	case '}':
+		return expr, p.advance(1)
+	case '#':
+		return nil, p.sourceError("comments aren't allowed in interpolated strings")
+	case '\n':
+		return nil, p.sourceError("unexpected end of line")
+	}
+	return nil, p.sourceError("expected '}', found %#v", p.char(0))
+}
+
+// parseQuoted returns the contents of a quoted literal, or nil if the
+// input is not at one.
+func (p *Parser) parseQuoted(raw, bytes bool) ([]byte, error) {
+	quote := string(p.char(0))
+	switch quote {
+	case `"`, `'`:
+		if p.string(3) == strings.Repeat(quote, 3) {
+			quote = strings.Repeat(quote, 3)
+		}
+	case "`":
+		raw = true
+	default:
+		return nil, nil
+	}
+	if err := p.advance(len(quote)); err != nil {
+		return nil, err
 	}
-	args = append(args, arg)
+	val := []byte{}
 	for {
-		if _, err = p.skipAllWhitespace(); err != nil {
-			return nil, err
+		if p.eof() {
+			return nil, p.sourceError("unterminated string")
 		}
-		if p.char(0) == ')' {
-			if err := p.advance(1); err != nil {
+		if p.string(len(quote)) == quote {
+			return val, p.advance(len(quote))
+		}
+		r := p.char(0)
+		if r == '\n' && len(quote) == 1 && quote != "`" {
+			return nil, p.sourceError("unexpected end of line")
+		}
+		if r == '\\' && !raw {
+			escaped, err := p.parseEscape(bytes)
+			if err != nil {
 				return nil, err
 			}
-			return args, nil
-		}
-		if p.char(0) != ',' {
-			return nil, p.sourceError("unexpected character %#v", p.char(0))
+			val = append(val, escaped...)
+			continue
 		}
+		val = utf8.AppendRune(val, r)
 		if err := p.advance(1); err != nil {
 			return nil, err
 		}
-		if _, err = p.skipAllWhitespace(); err != nil {
-			return nil, err
-		}
-		arg, err := p.parseExpression()
-		if err != nil {
+	}
+}
+
+// parseEscape parses a backslash escape sequence, returning its UTF-8
+// encoding. \x and octal escapes denote code points, like \u and \U,
+// unless bytes is true, in which case they denote a single byte.
+func (p *Parser) parseEscape(bytes bool) ([]byte, error) {
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	r := p.char(0)
+	if simple, ok := simpleEscapes[r]; ok {
+		return []byte{simple}, p.advance(1)
+	}
+	var digits, base int
+	switch {
+	case r == 'x' || r == 'X':
+		digits, base = 2, 16
+	case r == 'u':
+		digits, base = 4, 16
+	case r == 'U':
+		digits, base = 8, 16
+	case r >= '0' && r <= '3':
+		digits, base = 3, 8
+	default:
+		return nil, p.sourceError("unexpected escape code: %#v", r)
+	}
+	if base == 16 {
+		if err := p.advance(1); err != nil {
 			return nil, err
 		}
-		if arg == nil {
-			return nil, p.sourceError("unexpected missing argument")
-		}
-		args = append(args, arg)
 	}
+	code, err := strconv.ParseUint(p.string(digits), base, 32)
+	if err != nil || len([]rune(p.string(digits))) != digits {
+		return nil, p.sourceError("invalid escape code: %#v", string(r)+p.string(digits))
+	}
+	if bytes && (r == 'x' || r == 'X' || base == 8) {
+		return []byte{byte(code)}, p.advance(digits)
+	}
+	if !utf8.ValidRune(rune(code)) {
+		return nil, p.sourceError("invalid code point: %#x", code)
+	}
+	return utf8.AppendRune(nil, rune(code)), p.advance(digits)
 }
 
-func (p *Parser) parseSubexpression() (Evaluable, error) {
-	if p.char(0) != '(' {
-		return p.parseFunctionCall()
+func (p *Parser) parseLiteral() (Evaluable, error) {
+	if p.keyword("match") {
+		return p.parseMatch()
 	}
-	if err := p.advance(1); err != nil {
+	str, err := p.parseString()
+	if err != nil {
 		return nil, err
 	}
-	if _, err := p.skipAllWhitespace(); err != nil {
-		return nil, err
+	if str != nil {
+		return str, nil
 	}
-	expr, err := p.parseExpression()
+	list, err := p.parseList()
 	if err != nil {
 		return nil, err
 	}
-	if expr == nil {
-		return nil, p.sourceError("missing subexpression")
+	if list != nil {
+		return list, nil
 	}
-	if _, err = p.skipAllWhitespace(); err != nil {
+	m, err := p.parseMap()
+	if err != nil {
 		return nil, err
 	}
-	if p.char(0) != ')' {
-		return nil, p.sourceError("subexpression ended unexpectedly, found %#v", p.char(0))
+	if m != nil {
+		return m, nil
 	}
-	if err = p.advance(1); err != nil {
+	ident, err := p.parseIdentifier()
+	if err != nil {
 		return nil, err
 	}
-	_, err = p.skipAllWhitespace()
-	return &Subexpression{Expr: expr}, err
+	if ident != nil {
+		return ident, nil
+	}
+	return p.parseValue()
 }
 
-func (p *Parser) parseExponentiation() (Evaluable, error) {
-	return p.parseOperation(
-		p.parseSubexpression,
-		map[OpType][]string{
-			OpExp: {"^"},
-		},
-	)
+func (p *Parser) parseFunctionCall() (Evaluable, error) {
+	val, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, nil
+	}
+	return p.parsePostfix(val)
 }
 
-func (p *Parser) parseValNegation() (Evaluable, error) {
-	return p.parseModifier(
-		p.parseExponentiation,
-		map[ModType][]string{
-			ModNeg: {"-"},
-		},
-	)
-}
+// parsePostfix parses any calls, selectors and indexes following val.
+// Once a null-safe ?.field, ?.[index] or ?.(args) appears, the rest of the
+// chain is null-safe too, so a?.b.c is null rather than an error when a is
+// null.
+func (p *Parser) parsePostfix(val Evaluable) (Evaluable, error) {
+	optional := false
+	for {
+		if p.eof() {
+			return val, nil
+		}
+		if p.char(0) == '?' && p.char(1) == '.' && !isDigit(p.char(2)) {
+			skip := 1
+			if p.char(2) == '[' || p.char(2) == '(' {
+				skip = 2
+			}
+			if err := p.advance(skip); err != nil {
+				return nil, err
+			}
+			optional = true
+		}
+		switch p.char(0) {
+		case '(':
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			if sel, ok := val.(*Select); ok {
+				if macros[sel.Field] {
+					val, err = p.newComprehension(sel, args, optional)
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+				val = &MethodCall{
+					X:        sel.X,
+					Name:     sel.Field,
+					Args:     args,
+					Optional: optional,
+				}
+				continue
+			}
+			val = &Call{
+				Func:     val,
+				Args:     args,
+				Optional: optional,
+			}
+		case '.':
+			if p.char(1) == '.' {
+				// a range, like x..y
+				_, err := p.skipAllWhitespace()
+				return val, err
+			}
+			field, err := p.parseSelector()
+			if err != nil {
+				return nil, err
+			}
+			val = &Select{
+				X:        val,
+				Field:    field,
+				Optional: optional,
+			}
+		case '[':
+			index, err := p.parseIndex()
+			if err != nil {
+				return nil, err
+			}
+			val = &Index{
+				X:        val,
+				Index:    index,
+				Optional: optional,
+			}
+		default:
+			_, err := p.skipAllWhitespace()
+			return val, err
+		}
+	}
+}
+
+func (p *Parser) parseIndex() (Evaluable, error) {
+	if p.char(0) != '[' {
+		return nil, nil
+	}
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	index, err := p.parseNestedExpression()
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return nil, p.sourceError("missing index")
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	if p.char(0) != ']' {
+		return nil, p.sourceError("index ended unexpectedly, found %#v", p.char(0))
+	}
+	return index, p.advance(1)
+}
+
+// newComprehension makes a Comprehension out of a macro call like
+// x.all(i, i > 0).
+func (p *Parser) newComprehension(sel *Select, args []Evaluable, optional bool) (Evaluable, error) {
+	if len(args) != 2 && !(sel.Field == "map" && len(args) == 3) {
+		return nil, p.sourceError("wrong number of arguments to %s", sel.Field)
+	}
+	ident, ok := args[0].(*Ident)
+	if !ok {
+		return nil, p.sourceError("%s expects a variable name as its first argument", sel.Field)
+	}
+	c := &Comprehension{
+		Macro:    sel.Field,
+		Range:    sel.X,
+		Var:      ident.Name,
+		Body:     args[len(args)-1],
+		Optional: optional,
+	}
+	if len(args) == 3 {
+		c.Filter = args[1]
+	}
+	return c, nil
+}
+
+func (p *Parser) parseSelector() (string, error) {
+	if p.char(0) != '.' {
+		return "", nil
+	}
+	if err := p.advance(1); err != nil {
+		return "", err
+	}
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return "", err
+	}
+	if disallowedStartingIdentChars[p.currentChar] {
+		return "", p.sourceError("unexpected character %#v", p.char(0))
+	}
+	field, err := p.parseChars(identChars)
+	if err != nil {
+		return "", err
+	}
+	if field == "" {
+		return "", p.sourceError("missing field name")
+	}
+	return field, nil
+}
+
+func (p *Parser) parseArgs() ([]Evaluable, error) {
+	return p.parseSequence('(', ')')
+}
+
+func (p *Parser) parseList() (Evaluable, error) {
+	items, err := p.parseSequence('[', ']')
+	if err != nil {
+		return nil, err
+	}
+	if items == nil {
+		return nil, nil
+	}
+	_, err = p.skipAllWhitespace()
+	return &List{Items: items}, err
+}
+
+func (p *Parser) parseMap() (Evaluable, error) {
+	if p.char(0) != '{' {
+		return nil, nil
+	}
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	m := &Map{}
+	constantKeys := map[any]bool{}
+	for {
+		if p.char(0) == '}' {
+			if err := p.advance(1); err != nil {
+				return nil, err
+			}
+			_, err := p.skipAllWhitespace()
+			return m, err
+		}
+		if len(m.Keys) > 0 {
+			if p.char(0) != ',' {
+				return nil, p.sourceError("unexpected character %#v", p.char(0))
+			}
+			if err := p.advance(1); err != nil {
+				return nil, err
+			}
+			if _, err := p.skipAllWhitespace(); err != nil {
+				return nil, err
+			}
+		}
+		key, err := p.parseNestedExpression()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, p.sourceError("unexpected missing key")
+		}
+		if c, ok := key.(constant); ok {
+			if k := c.constant(); isHashable(k) {
+				if constantKeys[k] {
+					return nil, p.sourceError("duplicate key %#v", k)
+				}
+				constantKeys[k] = true
+			}
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		if p.char(0) != ':' {
+			return nil, p.sourceError("expected ':', found %#v", p.char(0))
+		}
+		if err = p.advance(1); err != nil {
+			return nil, err
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		val, err := p.parseNestedExpression()
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			return nil, p.sourceError("unexpected missing value")
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		m.Keys = append(m.Keys, key)
+		m.Values = append(m.Values, val)
+	}
+}
+
+// parseSequence parses a comma separated list of expressions between open
+// and close. It returns nil if the input does not start with open.
+func (p *Parser) parseSequence(open, close rune) ([]Evaluable, error) {
+	if p.char(0) != open {
+		return nil, nil
+	}
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	items := []Evaluable{}
+	if p.char(0) == close {
+		if err := p.advance(1); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+	item, err := p.parseNestedExpression()
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, p.sourceError("unexpected missing item")
+	}
+	items = append(items, item)
+	for {
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		if p.char(0) == close {
+			if err := p.advance(1); err != nil {
+				return nil, err
+			}
+			return items, nil
+		}
+		if p.char(0) != ',' {
+			return nil, p.sourceError("unexpected character %#v", p.char(0))
+		}
+		if err := p.advance(1); err != nil {
+			return nil, err
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		item, err := p.parseNestedExpression()
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			return nil, p.sourceError("unexpected missing item")
+		}
+		items = append(items, item)
+	}
+}
+
+func (p *Parser) parseSubexpression() (Evaluable, error) {
+	if p.char(0) != '(' {
+		return p.parseFunctionCall()
+	}
+	lambda, err := p.parseLambda()
+	if err != nil || lambda != nil {
+		return lambda, err
+	}
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseNestedExpression()
+	if err != nil {
+		return nil, err
+	}
+	if expr == nil {
+		return nil, p.sourceError("missing subexpression")
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	if p.char(0) != ')' {
+		return nil, p.sourceError("subexpression ended unexpectedly, found %#v", p.char(0))
+	}
+	if err = p.advance(1); err != nil {
+		return nil, err
+	}
+	return p.parsePostfix(&Subexpression{Expr: expr})
+}
+
+// parseLambda parses a lambda like (x, y) => x + y, or returns nil without
+// consuming any input if there isn't one.
+func (p *Parser) parseLambda() (Evaluable, error) {
+	if p.noLambda {
+		return nil, nil
+	}
+	cpos, ccol, cline := p.checkpoint()
+	params, err := p.parseParams()
+	if err != nil || params == nil || p.string(2) != "=>" {
+		p.restore(cpos, ccol, cline)
+		return nil, nil
+	}
+	if err := p.advance(2); err != nil {
+		return nil, err
+	}
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	body, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, p.sourceError("missing lambda body")
+	}
+	return &Lambda{Params: params, Body: body}, nil
+}
+
+// parseParams parses a parenthesized list of parameter names, returning
+// nil if the input isn't one.
+func (p *Parser) parseParams() ([]string, error) {
+	if p.char(0) != '(' {
+		return nil, nil
+	}
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	params := []string{}
+	for {
+		if _, err := p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		if p.char(0) == ')' && len(params) == 0 {
+			break
+		}
+		if disallowedStartingIdentChars[p.currentChar] {
+			return nil, nil
+		}
+		param, err := p.parseChars(identChars)
+		if err != nil {
+			return nil, err
+		}
+		if param == "" || keywords[param] {
+			return nil, nil
+		}
+		params = append(params, param)
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		if p.char(0) == ')' {
+			break
+		}
+		if p.char(0) != ',' {
+			return nil, nil
+		}
+		if err = p.advance(1); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.advance(1); err != nil {
+		return nil, err
+	}
+	_, err := p.skipAllWhitespace()
+	return params, err
+}
+
+func (p *Parser) parseExponentiation() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseSubexpression,
+		map[OpType][]string{
+			OpExp: {"^"},
+		},
+	)
+}
+
+func (p *Parser) parseValNegation() (Evaluable, error) {
+	val, err := p.parseModifier(
+		p.parseExponentiation,
+		map[ModType][]string{
+			ModNeg:    {"-"},
+			ModBitNot: {"~"},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	// a negated duration literal is a negative duration literal, rather
+	// than an operation.
+	if mod, ok := val.(*Modifier); ok && mod.Type == ModNeg {
+		if dur, ok := mod.Val.(*Value[time.Duration]); ok {
+			return &Value[time.Duration]{Val: -dur.Val}, nil
+		}
+	}
+	return val, nil
+}
+
+func (p *Parser) parseMultiplicationDivision() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseValNegation,
+		map[OpType][]string{
+			OpMul:      {"*"},
+			OpDiv:      {"/"},
+			OpMod:      {"%"},
+			OpFloorDiv: {"//"},
+		},
+	)
+}
+
+func (p *Parser) parseAdditionSubtraction() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseMultiplicationDivision,
+		map[OpType][]string{
+			OpAdd: {"+"},
+			OpSub: {"-"},
+		},
+	)
+}
+
+func (p *Parser) parseShift() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseAdditionSubtraction,
+		map[OpType][]string{
+			OpShiftLeft:  {"<<"},
+			OpShiftRight: {">>"},
+		},
+	)
+}
+
+func (p *Parser) parseBitAnd() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseShift,
+		map[OpType][]string{
+			OpBitAnd: {"&"},
+		},
+	)
+}
+
+func (p *Parser) parseBitXor() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseBitAnd,
+		map[OpType][]string{
+			OpBitXor: {"xor"},
+		},
+	)
+}
+
+func (p *Parser) parseBitOr() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseBitXor,
+		map[OpType][]string{
+			OpBitOr: {"|"},
+		},
+	)
+}
+
+func (p *Parser) parseRange() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseBitOr,
+		map[OpType][]string{
+			OpRange:          {".."},
+			OpRangeExclusive: {"..<"},
+		},
+	)
+}
+
+func (p *Parser) parseComparison() (Evaluable, error) {
+	ops := map[OpType][]string{
+		OpLess:         {"<"},
+		OpLessEqual:    {"<="},
+		OpEqual:        {"=="},
+		OpNotEqual:     {"!=", "~=", "<>"},
+		OpGreater:      {">"},
+		OpGreaterEqual: {">="},
+		OpIn:           {"in"},
+		OpMatch:        {"=~"},
+		OpNotMatch:     {"!~"},
+	}
+	if p.noIn {
+		delete(ops, OpIn)
+	}
+	first, err := p.parseRange()
+	if err != nil {
+		return nil, err
+	}
+	if first == nil {
+		return nil, nil
+	}
+	// orderings chain, like a < b <= c. Other comparisons are left
+	// associative, so a < b == c is (a < b) == c.
+	cmp := &Comparison{Operands: []Evaluable{first}}
+	for !p.eof() {
+		cpos, ccol, cline := p.checkpoint()
+		cls, rhs, err := parseOpAndRHS(p, p.parseRange, ops)
+		if err != nil {
+			return nil, err
+		}
+		if cls == OpOrModNil {
+			break
+		}
+		if cls == OpMatch || cls == OpNotMatch {
+			if rhs, err = compilePattern(rhs); err != nil {
+				p.restore(cpos, ccol, cline)
+				return nil, p.sourceError("%v", err)
+			}
+		}
+		if !orderings[cls] {
+			cmp = &Comparison{Operands: []Evaluable{
+				&Operation{Type: cls, Left: cmp.simplify(), Right: rhs},
+			}}
+			continue
+		}
+		cmp.Ops = append(cmp.Ops, cls)
+		cmp.Operands = append(cmp.Operands, rhs)
+	}
+	return cmp.simplify(), nil
+}
+
+func (p *Parser) parseBoolNegation() (Evaluable, error) {
+	return p.parseModifier(
+		p.parseComparison,
+		map[ModType][]string{
+			ModNot: {"!", "not"},
+		},
+	)
+}
+
+func (p *Parser) parseConjunction() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseBoolNegation,
+		map[OpType][]string{
+			OpAnd: {"&&", "and"},
+		},
+	)
+}
+
+func (p *Parser) parseDisjunction() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseConjunction,
+		map[OpType][]string{
+			OpOr: {"||", "or"},
+		},
+	)
+}
+
+func (p *Parser) parseCoalesce() (Evaluable, error) {
+	return p.parseOperation(
+		p.parseDisjunction,
+		map[OpType][]string{
+			OpCoalesce: {"??"},
+		},
+	)
+}
+
+// parsePipe parses pipelines like x |> f(a) |> g, which are shorthand for
+// g(f(x, a)).
+func (p *Parser) parsePipe() (Evaluable, error) {
+	val, err := p.parseCoalesce()
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, nil
+	}
+	for p.string(2) == "|>" {
+		if err = p.advance(2); err != nil {
+			return nil, err
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		fn, err := p.parseSubexpression()
+		if err != nil {
+			return nil, err
+		}
+		if fn == nil {
+			return nil, p.sourceError("missing pipe target")
+		}
+		val = pipe(val, fn)
+	}
+	return val, nil
+}
+
+// pipe inserts val as the first argument of the call fn, or if fn isn't a
+// call, makes a call of fn with val as the only argument.
+func pipe(val, fn Evaluable) Evaluable {
+	switch fn := fn.(type) {
+	case *Call:
+		return &Call{Func: fn.Func, Args: append([]Evaluable{val}, fn.Args...), Optional: fn.Optional}
+	case *MethodCall:
+		return &MethodCall{X: fn.X, Name: fn.Name, Args: append([]Evaluable{val}, fn.Args...), Optional: fn.Optional}
+	}
+	return &Call{Func: fn, Args: []Evaluable{val}}
+}
+
+func (p *Parser) parseOperation(valueParse func() (Evaluable, error),
+	opMap map[OpType][]string) (Evaluable, error) {
+	val, err := valueParse()
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, nil
+	}
+	for {
+		if p.eof() {
+			return val, nil
+		}
+		cls, rhs, err := parseOpAndRHS(p, valueParse, opMap)
+		if err != nil {
+			return nil, err
+		}
+		if cls == OpOrModNil {
+			return val, nil
+		}
+		val = &Operation{
+			Type:  cls,
+			Left:  val,
+			Right: rhs,
+		}
+	}
+}
+
+func (p *Parser) parseModifier(valueParse func() (Evaluable, error),
+	modMap map[ModType][]string) (Evaluable, error) {
+	cls, val, err := parseOpAndRHS(p, valueParse, modMap)
+	if err != nil {
+		return nil, err
+	}
+	if cls != OpOrModNil {
+		return &Modifier{
+			Type: cls,
+			Val:  val,
+		}, nil
+	}
+	return valueParse()
+}
+
+func (p *Parser) isBoundary(char1, char2 rune) bool {
+	return !identChars[char1] || !identChars[char2]
+}
+
+func parseOpAndRHS[T OpType | ModType](p *Parser, valueParse func() (Evaluable, error),
+	opMap map[T][]string) (T, Evaluable, error) {
+	cpos, ccol, cline := p.checkpoint()
+	for cls, operators := range opMap {
+		for _, op := range operators {
+			if strings.ToLower(p.string(len(op))) == op && p.isBoundary(p.char(len(op)-1), p.char(len(op))) {
+				if err := p.advance(len(op)); err != nil {
+					return OpOrModNil, nil, err
+				}
+				if _, err := p.skipAllWhitespace(); err != nil {
+					return OpOrModNil, nil, err
+				}
+				rhs, err := valueParse()
+				if err != nil {
+					return OpOrModNil, nil, err
+				}
+				if rhs != nil {
+					return cls, rhs, nil
+				}
+				p.restore(cpos, ccol, cline)
+			}
+		}
+	}
+	return OpOrModNil, nil, nil
+}
 
-func (p *Parser) parseMultiplicationDivision() (Evaluable, error) {
-	return p.parseOperation(
-		p.parseValNegation,
-		map[OpType][]string{
-			OpMul: {"*"},
-			OpDiv: {"/"},
-		},
-	)
+func (p *Parser) Parse() (Evaluable, error) {
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	val, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if !p.eof() {
+		return nil, p.sourceError("unparsed input")
+	}
+	if val == nil {
+		return nil, p.sourceError("nothing parsed")
+	}
+	return val, nil
 }
 
-func (p *Parser) parseAdditionSubtraction() (Evaluable, error) {
-	return p.parseOperation(
-		p.parseMultiplicationDivision,
-		map[OpType][]string{
-			OpAdd: {"+"},
-			OpSub: {"-"},
-		},
-	)
+func (p *Parser) parseExpression() (Evaluable, error) {
+	if p.keyword("let") {
+		return p.parseLet()
+	}
+	return p.parseConditional()
 }
 
-func (p *Parser) parseComparison() (Evaluable, error) {
-	return p.parseOperation(
-		p.parseAdditionSubtraction,
-		map[OpType][]string{
-			OpLess:         {"<"},
-			OpLessEqual:    {"<="},
-			OpEqual:        {"=="},
-			OpNotEqual:     {"!=", "~=", "<>"},
-			OpGreater:      {">"},
-			OpGreaterEqual: {">="},
-		},
-	)
+// parseNestedExpression parses an expression inside brackets, where in is
+// always an operator, even inside a let binding.
+func (p *Parser) parseNestedExpression() (Evaluable, error) {
+	noIn, noLambda := p.noIn, p.noLambda
+	p.noIn, p.noLambda = false, false
+	defer func() { p.noIn, p.noLambda = noIn, noLambda }()
+	return p.parseExpression()
 }
 
-func (p *Parser) parseBoolNegation() (Evaluable, error) {
-	return p.parseModifier(
-		p.parseComparison,
-		map[ModType][]string{
-			ModNot: {"!", "not"},
-		},
-	)
+// parsePatternExpression parses an expression in a match pattern, where a
+// parenthesized value followed by => isn't a lambda.
+func (p *Parser) parsePatternExpression() (Evaluable, error) {
+	noIn, noLambda := p.noIn, p.noLambda
+	p.noIn, p.noLambda = false, true
+	defer func() { p.noIn, p.noLambda = noIn, noLambda }()
+	return p.parseExpression()
 }
 
-func (p *Parser) parseConjunction() (Evaluable, error) {
-	return p.parseOperation(
-		p.parseBoolNegation,
-		map[OpType][]string{
-			OpAnd: {"&&", "and"},
-		},
-	)
+func (p *Parser) parseLet() (Evaluable, error) {
+	if err := p.expectKeyword("let"); err != nil {
+		return nil, err
+	}
+	let := &Let{}
+	for {
+		if disallowedStartingIdentChars[p.currentChar] {
+			return nil, p.sourceError("expected variable name, found %#v", p.char(0))
+		}
+		name, err := p.parseChars(identChars)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" || keywords[name] {
+			return nil, p.sourceError("expected variable name, found %#v", name)
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		if p.char(0) != '=' || p.char(1) == '=' {
+			return nil, p.sourceError("expected '=', found %#v", p.char(0))
+		}
+		if err = p.advance(1); err != nil {
+			return nil, err
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		noIn := p.noIn
+		p.noIn = true
+		val, err := p.parseExpression()
+		p.noIn = noIn
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			return nil, p.sourceError("missing value for %#v", name)
+		}
+		let.Names = append(let.Names, name)
+		let.Values = append(let.Values, val)
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		if p.char(0) != ',' {
+			break
+		}
+		if err = p.advance(1); err != nil {
+			return nil, err
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("in"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, p.sourceError("missing let body")
+	}
+	let.Body = body
+	return let, nil
 }
 
-func (p *Parser) parseDisjunction() (Evaluable, error) {
-	return p.parseOperation(
-		p.parseConjunction,
-		map[OpType][]string{
-			OpOr: {"||", "or"},
-		},
-	)
+// parseMatch parses a match expression like
+//
+//	match x { case 1, 2 => "low", case in limits => "known", case n if n > 10 => "high", _ => "mid" }
+func (p *Parser) parseMatch() (Evaluable, error) {
+	cpos, ccol, cline := p.checkpoint()
+	if err := p.expectKeyword("match"); err != nil {
+		return nil, err
+	}
+	val, err := p.parseNestedExpression()
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, p.sourceError("missing match value")
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	if p.char(0) != '{' {
+		return nil, p.sourceError("expected '{', found %#v", p.char(0))
+	}
+	if err = p.advance(1); err != nil {
+		return nil, err
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	m := &Match{Value: val}
+	hasDefault := false
+	for p.char(0) != '}' {
+		arm, err := p.parseMatchArm()
+		if err != nil {
+			return nil, err
+		}
+		hasDefault = hasDefault || arm.isDefault()
+		m.Arms = append(m.Arms, arm)
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+		if p.char(0) == '}' {
+			break
+		}
+		if p.char(0) != ',' {
+			return nil, p.sourceError("expected ',' or '}', found %#v", p.char(0))
+		}
+		if err = p.advance(1); err != nil {
+			return nil, err
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Arms) == 0 {
+		return nil, p.sourceError("match has no arms")
+	}
+	if !hasDefault {
+		line, col := p.sourceRef(cpos, ccol, cline)
+		p.Warnings = append(p.Warnings, fmt.Sprintf("line %d, column %d: match has no default arm", line, col))
+	}
+	if err = p.advance(1); err != nil {
+		return nil, err
+	}
+	_, err = p.skipAllWhitespace()
+	return m, err
 }
 
-func (p *Parser) parseOperation(valueParse func() (Evaluable, error),
-	opMap map[OpType][]string) (Evaluable, error) {
-	val, err := valueParse()
+func (p *Parser) parseMatchArm() (*MatchArm, error) {
+	arm := &MatchArm{}
+	if p.char(0) == '_' && p.isBoundary(p.char(0), p.char(1)) {
+		if err := p.advance(1); err != nil {
+			return nil, err
+		}
+		if _, err := p.skipAllWhitespace(); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := p.expectKeyword("case"); err != nil {
+			return nil, err
+		}
+		if err := p.parsePattern(arm); err != nil {
+			return nil, err
+		}
+		if p.keyword("if") {
+			if err := p.expectKeyword("if"); err != nil {
+				return nil, err
+			}
+			guard, err := p.parsePatternExpression()
+			if err != nil {
+				return nil, err
+			}
+			if guard == nil {
+				return nil, p.sourceError("missing guard")
+			}
+			arm.Guard = guard
+		}
+	}
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	if p.string(2) != "=>" {
+		return nil, p.sourceError("expected '=>', found %#v", p.char(0))
+	}
+	if err := p.advance(2); err != nil {
+		return nil, err
+	}
+	if _, err := p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	body, err := p.parseNestedExpression()
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, p.sourceError("missing match arm body")
+	}
+	arm.Body = body
+	return arm, nil
+}
+
+// parsePattern parses the pattern of a case arm: in followed by a
+// collection, a lone variable name if a guard follows, or otherwise a
+// comma separated list of values.
+func (p *Parser) parsePattern(arm *MatchArm) error {
+	if p.keyword("in") {
+		if err := p.expectKeyword("in"); err != nil {
+			return err
+		}
+		in, err := p.parsePatternExpression()
+		if err != nil {
+			return err
+		}
+		if in == nil {
+			return p.sourceError("missing collection for in pattern")
+		}
+		arm.In = in
+		return nil
+	}
+	for {
+		val, err := p.parsePatternExpression()
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			return p.sourceError("missing pattern")
+		}
+		arm.Values = append(arm.Values, val)
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return err
+		}
+		if p.char(0) != ',' {
+			break
+		}
+		if err = p.advance(1); err != nil {
+			return err
+		}
+		if _, err = p.skipAllWhitespace(); err != nil {
+			return err
+		}
+	}
+	if ident, ok := arm.Values[0].(*Ident); ok && len(arm.Values) == 1 && p.keyword("if") {
+		arm.Bind, arm.Values = ident.Name, nil
+	}
+	return nil
+}
+
+// keyword returns true if the input continues with the keyword word.
+func (p *Parser) keyword(word string) bool {
+	return p.string(len(word)) == word && p.isBoundary(p.char(len(word)-1), p.char(len(word)))
+}
+
+func (p *Parser) expectKeyword(word string) error {
+	if !p.keyword(word) {
+		return p.sourceError("expected %#v", word)
+	}
+	if err := p.advance(len(word)); err != nil {
+		return err
+	}
+	_, err := p.skipAllWhitespace()
+	return err
+}
+
+func (p *Parser) parseConditional() (Evaluable, error) {
+	if p.keyword("if") {
+		if err := p.expectKeyword("if"); err != nil {
+			return nil, err
+		}
+		cond, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if cond == nil {
+			return nil, p.sourceError("missing condition")
+		}
+		if err = p.expectKeyword("then"); err != nil {
+			return nil, err
+		}
+		then, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if then == nil {
+			return nil, p.sourceError("missing then branch")
+		}
+		if err = p.expectKeyword("else"); err != nil {
+			return nil, err
+		}
+		els, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if els == nil {
+			return nil, p.sourceError("missing else branch")
+		}
+		return &Conditional{Cond: cond, Then: then, Else: els}, nil
+	}
+
+	cond, err := p.parsePipe()
+	if err != nil {
+		return nil, err
+	}
+	if cond == nil {
+		return nil, nil
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	if p.char(0) != '?' {
+		return cond, nil
+	}
+	if err = p.advance(1); err != nil {
+		return nil, err
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	then, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	if then == nil {
+		return nil, p.sourceError("missing then branch")
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	if p.char(0) != ':' {
+		return nil, p.sourceError("expected ':', found %#v", p.char(0))
+	}
+	if err = p.advance(1); err != nil {
+		return nil, err
+	}
+	if _, err = p.skipAllWhitespace(); err != nil {
+		return nil, err
+	}
+	els, err := p.parseConditional()
 	if err != nil {
 		return nil, err
 	}
-	if val == nil {
-		return nil, nil
+	if els == nil {
+		return nil, p.sourceError("missing else branch")
 	}
-	for {
-		if p.eof() {
-			return val, nil
-		}
-		cls, rhs, err := parseOpAndRHS(p, valueParse, opMap)
+	return &Conditional{Cond: cond, Then: then, Else: els}, nil
+}
+
+// Interpolation concatenates Parts, which must evaluate to strings. Values
+// embedded in an interpolated string are formatted by a Modifier of type
+// ModFormat, so the environment decides how they look.
+type Interpolation struct {
+	Parts []Evaluable
+}
+
+func (i *Interpolation) Run(env map[any]any) (any, error) {
+	var b strings.Builder
+	for _, part := range i.Parts {
+		val, err := part.Run(env)
 		if err != nil {
 			return nil, err
 		}
-		if cls == OpOrModNil {
-			return val, nil
-		}
-		val = &Operation{
-			Type:  cls,
-			Left:  val,
-			Right: rhs,
+		s, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: interpolated %T instead of string", ErrTypeMismatch, val)
 		}
+		b.WriteString(s)
 	}
+	return b.String(), nil
 }
 
-func (p *Parser) parseModifier(valueParse func() (Evaluable, error),
-	modMap map[ModType][]string) (Evaluable, error) {
-	cls, val, err := parseOpAndRHS(p, valueParse, modMap)
-	if err != nil {
-		return nil, err
-	}
-	if cls != OpOrModNil {
-		return &Modifier{
-			Type: cls,
-			Val:  val,
-		}, nil
-	}
-	return valueParse()
+// Match evaluates the Body of the first of Arms that matches Value. It is an
+// error if no arm matches. match and case are reserved words, so they can't
+// be used as variable or parameter names.
+type Match struct {
+	Value Evaluable
+	Arms  []*MatchArm
 }
 
-func (p *Parser) isBoundary(char1, char2 rune) bool {
-	return !identChars[char1] || !identChars[char2]
+// MatchArm matches if Value equals any of Values, if Value is in In, or,
+// if neither is set, always. If Bind is set, Value is bound to it for
+// Guard and Body. If Guard is set, it must also be true for the arm to
+// match.
+type MatchArm struct {
+	Values []Evaluable
+	In     Evaluable
+	Bind   string
+	Guard  Evaluable
+	Body   Evaluable
 }
 
-func parseOpAndRHS[T OpType | ModType](p *Parser, valueParse func() (Evaluable, error),
-	opMap map[T][]string) (T, Evaluable, error) {
-	cpos, ccol, cline := p.checkpoint()
-	for cls, operators := range opMap {
-		for _, op := range operators {
-			if strings.ToLower(p.string(len(op))) == op && p.isBoundary(p.char(len(op)-1), p.char(len(op))) {
-				if err := p.advance(len(op)); err != nil {
-					return OpOrModNil, nil, err
-				}
-				if _, err := p.skipAllWhitespace(); err != nil {
-					return OpOrModNil, nil, err
-				}
-				rhs, err := valueParse()
-				if err != nil {
-					return OpOrModNil, nil, err
-				}
-				if rhs != nil {
-					return cls, rhs, nil
-				}
-				p.restore(cpos, ccol, cline)
-			}
-		}
-	}
-	return OpOrModNil, nil, nil
+func (a *MatchArm) isDefault() bool {
+	return a.Values == nil && a.In == nil && a.Guard == nil
 }
 
-func (p *Parser) Parse() (Evaluable, error) {
-	if _, err := p.skipAllWhitespace(); err != nil {
-		return nil, err
-	}
-	val, err := p.parseExpression()
+func (m *Match) Run(env map[any]any) (any, error) {
+	val, err := m.Value.Run(env)
 	if err != nil {
 		return nil, err
 	}
-	if !p.eof() {
-		return nil, p.sourceError("unparsed input")
-	}
-	if val == nil {
-		return nil, p.sourceError("nothing parsed")
+	for _, arm := range m.Arms {
+		scope := env
+		if arm.Bind != "" {
+			scope = newScope(env, map[any]any{arm.Bind: val})
+		}
+		matched, err := arm.matches(scope, val)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			return arm.Body.Run(scope)
+		}
 	}
-	return val, nil
+	return nil, fmt.Errorf("%w: no match for %#v", ErrValueMismatch, val)
 }
 
-func (p *Parser) parseExpression() (Evaluable, error) {
-	return p.parseDisjunction()
+func (a *MatchArm) matches(env map[any]any, val any) (bool, error) {
+	matched := a.Values == nil && a.In == nil
+	for _, pattern := range a.Values {
+		p, err := pattern.Run(env)
+		if err != nil {
+			return false, err
+		}
+		eq, err := equalHelper(env, val, p)
+		if err != nil {
+			return false, err
+		}
+		if eq {
+			matched = true
+			break
+		}
+	}
+	if a.In != nil {
+		in, err := (&Operation{Type: OpIn, Left: &Value[any]{Val: val}, Right: a.In}).Run(env)
+		if err != nil {
+			return false, err
+		}
+		if matched, _ = in.(bool); !matched {
+			return false, nil
+		}
+	}
+	if !matched || a.Guard == nil {
+		return matched, nil
+	}
+	return runBool(env, a.Guard)
 }
 
 type Subexpression struct {
@@ -611,9 +1986,55 @@ func (s *Subexpression) Run(env map[any]any) (any, error) {
 	return s.Expr.Run(env)
 }
 
+// Let evaluates each of Values once, in order, binding it to the
+// corresponding name in Names for the rest of the Values and for Body.
+type Let struct {
+	Names  []string
+	Values []Evaluable
+	Body   Evaluable
+}
+
+func (l *Let) Run(env map[any]any) (any, error) {
+	scope := env
+	for i, name := range l.Names {
+		val, err := l.Values[i].Run(scope)
+		if err != nil {
+			return nil, err
+		}
+		scope = newScope(scope, map[any]any{name: val})
+	}
+	return l.Body.Run(scope)
+}
+
+// Conditional evaluates only one of Then or Else, depending on Cond,
+// which must be a bool.
+type Conditional struct {
+	Cond Evaluable
+	Then Evaluable
+	Else Evaluable
+}
+
+func (c *Conditional) Run(env map[any]any) (any, error) {
+	condUncasted, err := c.Cond.Run(env)
+	if err != nil {
+		return nil, err
+	}
+	cond, ok := condUncasted.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%w: bool expected: %#v", ErrTypeMismatch, condUncasted)
+	}
+	if cond {
+		return c.Then.Run(env)
+	}
+	return c.Else.Run(env)
+}
+
+// Call calls Func with Args. If Optional is set, a null Func results in
+// null instead of an error.
 type Call struct {
-	Func Evaluable
-	Args []Evaluable
+	Func     Evaluable
+	Args     []Evaluable
+	Optional bool
 }
 
 func (c *Call) Run(env map[any]any) (rv any, err error) {
@@ -621,20 +2042,83 @@ func (c *Call) Run(env map[any]any) (rv any, err error) {
 	if err != nil {
 		return nil, err
 	}
-	args := make([]reflect.Value, 0, len(c.Args))
-	for _, arg := range c.Args {
-		res, err := arg.Run(env)
+	if c.Optional && isNil(f) {
+		return nil, nil
+	}
+	args, err := runAll(env, c.Args)
+	if err != nil {
+		return nil, err
+	}
+	return call(f, args)
+}
+
+// MethodCall is a call like x.f(args). It calls the method or callable
+// field f of X if there is one, and otherwise the function f from the
+// environment as f(x, args). If Optional is set, a null X results in null
+// instead of an error.
+type MethodCall struct {
+	X        Evaluable
+	Name     string
+	Args     []Evaluable
+	Optional bool
+}
+
+func (m *MethodCall) Run(env map[any]any) (any, error) {
+	x, err := m.X.Run(env)
+	if err != nil {
+		return nil, err
+	}
+	if m.Optional && isNil(x) {
+		return nil, nil
+	}
+	args, err := runAll(env, m.Args)
+	if err != nil {
+		return nil, err
+	}
+	method, err := selectField(x, m.Name)
+	if err == nil && reflect.ValueOf(method).Kind() == reflect.Func {
+		return call(method, args)
+	}
+	if f, ok := Lookup(env, m.Name); ok {
+		return call(f, append([]any{x}, args...))
+	}
+	return nil, fmt.Errorf("%w: no method or function %q for %T", ErrUnknownField, m.Name, x)
+}
+
+// runAll evaluates each of exprs.
+func runAll(env map[any]any, exprs []Evaluable) ([]any, error) {
+	vals := make([]any, 0, len(exprs))
+	for _, expr := range exprs {
+		val, err := expr.Run(env)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+	}
+	return vals, nil
+}
+
+// call calls the Go func f with args, which may return a single value, or
+// a value and an error.
+func call(f any, args []any) (rv any, err error) {
+	fv := reflect.ValueOf(f)
+	if fv.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%w: %T is not callable", ErrTypeMismatch, f)
+	}
+	argvs := make([]reflect.Value, 0, len(args))
+	for i, arg := range args {
+		argv, err := callArg(fv.Type(), i, arg)
 		if err != nil {
 			return nil, err
 		}
-		args = append(args, reflect.ValueOf(res))
+		argvs = append(argvs, argv)
 	}
 	defer func() {
 		if recv := recover(); recv != nil {
 			err = fmt.Errorf("%w: %v", ErrTypeMismatch, recv)
 		}
 	}()
-	result := reflect.ValueOf(f).Call(args)
+	result := fv.Call(argvs)
 	switch len(result) {
 	case 1:
 		return result[0].Interface(), nil
@@ -653,19 +2137,227 @@ func (c *Call) Run(env map[any]any) (rv any, err error) {
 	}
 }
 
+// Func is what a Lambda evaluates to. When a Func is passed to a Go
+// function expecting some other type of func, it is adapted to that type,
+// which must have an error as its last result.
+type Func func(args ...any) (any, error)
+
+// Lambda evaluates to a Func that runs Body with Params bound to its
+// arguments, in the scope the Lambda was evaluated in.
+type Lambda struct {
+	Params []string
+	Body   Evaluable
+}
+
+func (l *Lambda) Run(env map[any]any) (any, error) {
+	return Func(func(args ...any) (any, error) {
+		if len(args) != len(l.Params) {
+			return nil, fmt.Errorf("%w: lambda expects %d arguments, got %d", ErrTypeMismatch, len(l.Params), len(args))
+		}
+		vars := make(map[any]any, len(args))
+		for i, param := range l.Params {
+			vars[param] = args[i]
+		}
+		return l.Body.Run(newScope(env, vars))
+	}), nil
+}
+
+// Select looks up Field on X. If Optional is set, a null X results in
+// null instead of an error.
+type Select struct {
+	X        Evaluable
+	Field    string
+	Optional bool
+}
+
+func (s *Select) Run(env map[any]any) (any, error) {
+	x, err := s.X.Run(env)
+	if err != nil {
+		return nil, err
+	}
+	if s.Optional && isNil(x) {
+		return nil, nil
+	}
+	return selectField(x, s.Field)
+}
+
+// Index looks up Index in X, which can be a slice, array, map, string or
+// []byte. Strings are indexed by rune, not by byte, and result in a one
+// rune string. []byte values are indexed by byte and result in an int64.
+// If Optional is set, as in x?.[i], a null X results in null instead of an
+// error, without evaluating Index.
+type Index struct {
+	X        Evaluable
+	Index    Evaluable
+	Optional bool
+}
+
+func (i *Index) Run(env map[any]any) (any, error) {
+	x, err := i.X.Run(env)
+	if err != nil {
+		return nil, err
+	}
+	if i.Optional && isNil(x) {
+		return nil, nil
+	}
+	index, err := i.Index.Run(env)
+	if err != nil {
+		return nil, err
+	}
+	return indexValue(x, index)
+}
+
+type List struct {
+	Items []Evaluable
+}
+
+func (l *List) Run(env map[any]any) (any, error) {
+	rv := make([]any, 0, len(l.Items))
+	for _, item := range l.Items {
+		val, err := item.Run(env)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, val)
+	}
+	return rv, nil
+}
+
+// Map evaluates to a map[any]any. Keys must be hashable and unique.
+type Map struct {
+	Keys   []Evaluable
+	Values []Evaluable
+}
+
+func (m *Map) Run(env map[any]any) (any, error) {
+	rv := make(map[any]any, len(m.Keys))
+	for i := range m.Keys {
+		key, err := m.Keys[i].Run(env)
+		if err != nil {
+			return nil, err
+		}
+		if !isHashable(key) {
+			return nil, fmt.Errorf("%w: unhashable key type %T", ErrTypeMismatch, key)
+		}
+		if _, exists := rv[key]; exists {
+			return nil, fmt.Errorf("%w: duplicate key %#v", ErrValueMismatch, key)
+		}
+		val, err := m.Values[i].Run(env)
+		if err != nil {
+			return nil, err
+		}
+		rv[key] = val
+	}
+	return rv, nil
+}
+
+// Comprehension evaluates Body for each element of Range, a slice, array,
+// or map (for which it iterates over the keys), with Var bound to the
+// element. Macro is one of:
+//
+//   - all: whether Body is true for every element.
+//   - exists: whether Body is true for any element.
+//   - exists_one: whether Body is true for exactly one element.
+//   - filter: a list of the elements for which Body is true.
+//   - map: a list of Body's results, skipping elements for which Filter,
+//     if set, is false.
+//
+// If Optional is set, as in x?.map(i, i), a null Range results in null
+// instead of an error.
+type Comprehension struct {
+	Macro    string
+	Range    Evaluable
+	Var      string
+	Filter   Evaluable
+	Body     Evaluable
+	Optional bool
+}
+
+func (c *Comprehension) Run(env map[any]any) (any, error) {
+	rangeVal, err := c.Range.Run(env)
+	if err != nil {
+		return nil, err
+	}
+	if c.Optional && isNil(rangeVal) {
+		return nil, nil
+	}
+	var (
+		result = c.Macro == "all"
+		count  int
+		list   = []any{}
+	)
+	err = iterate(rangeVal, func(elem any) (bool, error) {
+		scope := newScope(env, map[any]any{c.Var: elem})
+		switch c.Macro {
+		case "map":
+			if c.Filter != nil {
+				keep, err := runBool(scope, c.Filter)
+				if err != nil || !keep {
+					return false, err
+				}
+			}
+			val, err := c.Body.Run(scope)
+			if err != nil {
+				return false, err
+			}
+			list = append(list, val)
+			return false, nil
+		}
+		cond, err := runBool(scope, c.Body)
+		if err != nil {
+			return false, err
+		}
+		switch c.Macro {
+		case "all", "exists":
+			if cond != result {
+				result = cond
+				return true, nil
+			}
+			return false, nil
+		case "exists_one":
+			if cond {
+				count++
+			}
+			return count > 1, nil
+		case "filter":
+			if cond {
+				list = append(list, elem)
+			}
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %#v", ErrUnknownOp, c.Macro)
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch c.Macro {
+	case "exists_one":
+		return count == 1, nil
+	case "map", "filter":
+		return list, nil
+	}
+	return result, nil
+}
+
 type Operation struct {
 	Type  OpType
 	Left  Evaluable
 	Right Evaluable
 }
 
+// Operation calls the op registered in the environment for Type. Ops are
+// usually a func(env map[any]any, a, b any) (any, error), which is called
+// with both sides already evaluated, but can also be a
+// func(env map[any]any, a, b Evaluable) (any, error), which is responsible
+// for evaluating the sides itself, such as to short-circuit. Ops should
+// read other values from env with Lookup.
 func (o *Operation) Run(env map[any]any) (any, error) {
-	callableUncast, ok := env[o.Type]
+	callableUncast, ok := Lookup(env, o.Type)
 	if !ok {
-		callableUncast, ok = defaultEnv[o.Type]
-		if !ok {
-			return nil, fmt.Errorf("%w: %#v", ErrUnknownOp, o.Type)
-		}
+		return nil, fmt.Errorf("%w: %#v", ErrUnknownOp, o.Type)
+	}
+	if lazy, ok := callableUncast.(func(env map[any]any, a, b Evaluable) (any, error)); ok {
+		return lazy(env, o.Left, o.Right)
 	}
 	callable, ok := callableUncast.(func(env map[any]any, a, b any) (any, error))
 	if !ok {
@@ -682,23 +2374,119 @@ func (o *Operation) Run(env map[any]any) (any, error) {
 	return callable(env, lhs, rhs)
 }
 
+// compilePattern compiles pattern ahead of time if it's a constant string,
+// so that it's compiled only once and errors are found at parse time.
+func compilePattern(pattern Evaluable) (Evaluable, error) {
+	c, ok := pattern.(constant)
+	if !ok {
+		return pattern, nil
+	}
+	source, ok := c.constant().(string)
+	if !ok {
+		return pattern, nil
+	}
+	re, err := regexp.Compile(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %#v: %v", source, err)
+	}
+	return &Pattern{Source: source, Regexp: re}, nil
+}
+
+// Pattern is a constant pattern for OpMatch or OpNotMatch. It evaluates to
+// Source, so environments that override those ops still get a string, but
+// the default ops use Regexp instead of compiling Source again.
+type Pattern struct {
+	Source string
+	Regexp *regexp.Regexp
+}
+
+func (p *Pattern) Run(env map[any]any) (any, error) {
+	return p.Source, nil
+}
+
+func (p *Pattern) constant() any {
+	return p.Source
+}
+
+// Comparison is a chain of orderings like a < b <= c, which like in
+// Python means a < b and b <= c, except that b is only evaluated once.
+// Evaluation stops at the first comparison that is false. Ops[i] compares
+// Operands[i] with Operands[i+1].
+type Comparison struct {
+	Operands []Evaluable
+	Ops      []OpType
+}
+
+// orderings are the comparison ops that chain.
+var orderings = map[OpType]bool{OpLess: true, OpLessEqual: true, OpGreater: true, OpGreaterEqual: true}
+
+// simplify returns c as a single Operation or operand if it isn't a chain.
+func (c *Comparison) simplify() Evaluable {
+	switch len(c.Ops) {
+	case 0:
+		return c.Operands[0]
+	case 1:
+		return &Operation{Type: c.Ops[0], Left: c.Operands[0], Right: c.Operands[1]}
+	}
+	return c
+}
+
+func (c *Comparison) Run(env map[any]any) (any, error) {
+	lhs, err := c.Operands[0].Run(env)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range c.Ops {
+		rhs, err := c.Operands[i+1].Run(env)
+		if err != nil {
+			return nil, err
+		}
+		res, err := (&Operation{Type: op, Left: &Value[any]{Val: lhs}, Right: &Value[any]{Val: rhs}}).Run(env)
+		if err != nil {
+			return nil, err
+		}
+		ok, isBool := res.(bool)
+		if !isBool {
+			return nil, fmt.Errorf("%w: chained comparison %#v returned %T", ErrTypeMismatch, op, res)
+		}
+		if !ok {
+			return false, nil
+		}
+		lhs = rhs
+	}
+	return true, nil
+}
+
 type OpType string
 
 const (
-	OpOrModNil            = ""
-	OpExp          OpType = "^"
-	OpMul          OpType = "*"
-	OpDiv          OpType = "/"
-	OpAdd          OpType = "+"
-	OpSub          OpType = "-"
-	OpLess         OpType = "<"
-	OpLessEqual    OpType = "<="
-	OpEqual        OpType = "=="
-	OpNotEqual     OpType = "!="
-	OpGreater      OpType = ">"
-	OpGreaterEqual OpType = ">="
-	OpAnd          OpType = "&&"
-	OpOr           OpType = "||"
+	OpOrModNil              = ""
+	OpExp            OpType = "^"
+	OpMul            OpType = "*"
+	OpDiv            OpType = "/"
+	OpMod            OpType = "%"
+	OpFloorDiv       OpType = "//"
+	OpShiftLeft      OpType = "<<"
+	OpShiftRight     OpType = ">>"
+	OpBitAnd         OpType = "&"
+	OpBitXor         OpType = "xor"
+	OpBitOr          OpType = "|"
+	OpAdd            OpType = "+"
+	OpSub            OpType = "-"
+	OpRange          OpType = ".."
+	OpRangeExclusive OpType = "..<"
+	OpLess           OpType = "<"
+	OpLessEqual      OpType = "<="
+	OpEqual          OpType = "=="
+	OpNotEqual       OpType = "!="
+	OpGreater        OpType = ">"
+	OpGreaterEqual   OpType = ">="
+	OpIn             OpType = "in"
+	OpMatch          OpType = "=~"
+	OpNotMatch       OpType = "!~"
+	OpAnd            OpType = "&&"
+	OpOr             OpType = "||"
+	OpCoalesce       OpType = "??"
 )
 
 type Modifier struct {
@@ -706,13 +2494,13 @@ type Modifier struct {
 	Val  Evaluable
 }
 
+// Modifier calls the modifier registered in the environment for Type with
+// the evaluated Val, as a func(env map[any]any, a any) (any, error).
+// Modifiers should read other values from env with Lookup.
 func (m *Modifier) Run(env map[any]any) (any, error) {
-	callableUncast, ok := env[m.Type]
+	callableUncast, ok := Lookup(env, m.Type)
 	if !ok {
-		callableUncast, ok = defaultEnv[m.Type]
-		if !ok {
-			return nil, fmt.Errorf("%w: %#v", ErrUnknownOp, m.Type)
-		}
+		return nil, fmt.Errorf("%w: %#v", ErrUnknownOp, m.Type)
 	}
 	callable, ok := callableUncast.(func(env map[any]any, a any) (any, error))
 	if !ok {
@@ -728,8 +2516,10 @@ func (m *Modifier) Run(env map[any]any) (any, error) {
 type ModType string
 
 const (
-	ModNeg ModType = "-"
-	ModNot ModType = "!"
+	ModNeg    ModType = "-"
+	ModNot    ModType = "!"
+	ModBitNot ModType = "~"
+	ModFormat ModType = "format"
 )
 
 type Ident struct {
@@ -737,10 +2527,7 @@ type Ident struct {
 }
 
 func (i *Ident) Run(env map[any]any) (any, error) {
-	if v, ok := env[i.Name]; ok {
-		return v, nil
-	}
-	if v, ok := defaultEnv[i.Name]; ok {
+	if v, ok := Lookup(env, i.Name); ok {
 		return v, nil
 	}
 	return nil, fmt.Errorf("%w: %#v", ErrUnboundVar, i.Name)
@@ -754,6 +2541,16 @@ func (v *Value[T]) Run(env map[any]any) (any, error) {
 	return v.Val, nil
 }
 
+func (v *Value[T]) constant() any {
+	return v.Val
+}
+
+// constant is implemented by Evaluables whose value is known at parse
+// time.
+type constant interface {
+	constant() any
+}
+
 func Parse(expression string) (Evaluable, error) {
 	return NewParser(expression).Parse()
 }
@@ -1,7 +1,13 @@
 package mito
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,7 +26,7 @@ func testRun(t testing.TB, inputcb func(string)) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if val != expected {
+		if !reflect.DeepEqual(val, expected) {
 			t.Fatalf("input %#v with env %#v expected %#v %#T, got %#v %#T", input, env, expected, val, expected, val)
 		}
 	}
@@ -92,11 +98,621 @@ func testRun(t testing.TB, inputcb func(string)) {
 		t.Fatal("printed didn't work")
 	}
 
+	site := &testSite{
+		Name:      "ridge",
+		Elevation: 4200,
+		Climate: testClimate{
+			TminAvgMin2050: -5,
+		},
+		Secret: "hidden",
+	}
+	siteEnv := map[any]any{
+		"site": site,
+		"meta": map[string]any{
+			"region": map[string]any{"name": "west"},
+		},
+	}
+	checkResult(`site.elevation`, siteEnv, int64(4200))
+	checkResult(`site.Name + "!"`, siteEnv, "ridge!")
+	checkResult(`site.climate.tmin_avg_min_2050 >= -6`, siteEnv, true)
+	checkResult(`site.Describe("at ")`, siteEnv, "ridge at 4200")
+	checkResult(`site . Name`, siteEnv, "ridge")
+	checkResult(`meta.region.name`, siteEnv, "west")
+
+	type testRegion string
+	plainEnv := map[any]any{
+		"s": struct {
+			Elevation int        `mito:"elevation"`
+			Depth     int32      `mito:"depth"`
+			Count     uint16     `mito:"count"`
+			Ratio     float32    `mito:"ratio"`
+			Region    testRegion `mito:"region"`
+			Wait      time.Duration
+			Extra     any
+			Items     []int `mito:"items"`
+		}{Elevation: 4200, Depth: -3, Count: 2, Ratio: 0.5, Region: "west", Wait: time.Second, Extra: 7, Items: []int{1, 2}},
+		"m": map[string]int{"k": 5},
+	}
+	checkResult(`s.elevation + 1`, plainEnv, int64(4201))
+	checkResult(`s.elevation > 3`, plainEnv, true)
+	checkResult(`s.depth * 2`, plainEnv, int64(-6))
+	checkResult(`s.count`, plainEnv, int64(2))
+	checkResult(`s.count + 1`, plainEnv, int64(3))
+	checkResult(`s.count * 2 - s.depth`, plainEnv, int64(7))
+	checkResult(`big["a"]`, map[any]any{"big": map[string]uint{"a": math.MaxUint64}}, uint64(math.MaxUint64))
+	checkResult(`s.ratio + 1`, plainEnv, 1.5)
+	checkResult(`s.region == "west"`, plainEnv, true)
+	checkResult(`s.Wait`, plainEnv, time.Second)
+	checkResult(`s.Extra + 1`, plainEnv, int64(8))
+	checkResult(`m.k + 1`, plainEnv, int64(6))
+	checkResult(`2 in s.items`, plainEnv, true)
+
+	indexEnv := map[any]any{
+		"ids":    []int64{10, 20, 30},
+		"grid":   [2][2]string{{"a", "b"}, {"c", "d"}},
+		"limits": map[string]int64{"us": 10, "eu": 20},
+		"codes":  map[int]string{404: "missing"},
+		"word":   "héllo",
+		"raw":    []byte{0xde, 0xad},
+		"small":  []int32{1, 2, 3},
+	}
+	checkResult(`ids[1]`, indexEnv, int64(20))
+	checkResult(`ids[1 + 1] - ids[0]`, indexEnv, int64(20))
+	checkResult(`grid[1][0]`, indexEnv, "c")
+	checkResult(`limits["eu"]`, indexEnv, int64(20))
+	checkResult(`codes[404]`, indexEnv, "missing")
+	checkResult(`word[1]`, indexEnv, "é")
+	checkResult(`raw[1]`, indexEnv, int64(0xad))
+	checkResult(`site.Name[0]`, siteEnv, "r")
+
+	type testBytes []uint8
+	goIndexEnv := map[any]any{
+		"nums":   []int{1, 2},
+		"ratios": [2]float32{0.5, 1},
+		"counts": map[string]uint32{"a": 3},
+		"named":  testBytes{0xde, 0xad},
+		"keys":   map[int16]bool{4: true},
+	}
+	checkResult(`nums[0] + 1`, goIndexEnv, int64(2))
+	checkResult(`ratios[0] < ratios[1]`, goIndexEnv, true)
+	checkResult(`counts["a"] + 1`, goIndexEnv, int64(4))
+	checkResult(`named[1]`, goIndexEnv, int64(0xad))
+	checkResult(`nums.map(n, n * 10)`, goIndexEnv, []any{int64(10), int64(20)})
+	checkResult(`named.all(b, b > 100)`, goIndexEnv, true)
+	checkResult(`keys.map(k, k + 1)`, goIndexEnv, []any{int64(5)})
+
+	checkResult(`[]`, emptyEnv, []any{})
+	checkResult(`[1, "a", 2s]`, emptyEnv, []any{int64(1), "a", 2 * time.Second})
+	checkResult(`[1, [2, 3]][1][0]`, emptyEnv, int64(2))
+	checkResult(`[site.Name, print(4) + 1]`, map[any]any{
+		"site":  site,
+		"print": func(a int64) int64 { return a },
+	}, []any{"ridge", int64(5)})
+	checkResult(`[1, 2] + [3]`, emptyEnv, []any{int64(1), int64(2), int64(3)})
+	checkResult(`[1, 2] == [1, 2]`, emptyEnv, true)
+	checkResult(`[1, 2] == [1, 2, 3]`, emptyEnv, false)
+	checkResult(`[1, [2, "a"]] == [1.0, [2, "a"]]`, emptyEnv, true)
+	checkResult(`[1, 2] != [2, 1]`, emptyEnv, true)
+	checkResult(`[1] == 1`, emptyEnv, false)
+	checkResult(`ids == [10, 20, 30]`, indexEnv, true)
+
+	checkResult(`{}`, emptyEnv, map[any]any{})
+	checkResult(`{"us": 10, "eu": 1 + 1}`, emptyEnv, map[any]any{"us": int64(10), "eu": int64(2)})
+	checkResult(`{"us": 10, "eu": 20}[region]`, map[any]any{"region": "eu"}, int64(20))
+	checkResult(`{1: "a", 2s: [1]}[2s][0]`, emptyEnv, int64(1))
+	checkResult(`{"k": 1}.k`, emptyEnv, int64(1))
+	checkResult(`{"a": 1, "b": [2]} == {"b": [2], "a": 1.0}`, emptyEnv, true)
+	checkResult(`{"a": 1} == {"a": 2}`, emptyEnv, false)
+	checkResult(`{"a": 1} != {"b": 1}`, emptyEnv, true)
+	checkResult(`limits == {"us": 10, "eu": 20}`, indexEnv, true)
+	checkResult(`m == {"k": 5}`, plainEnv, true)
+	checkResult(`{"k": 5.0} == m`, plainEnv, true)
+	checkResult(`m != {"k": 6}`, plainEnv, true)
+
+	explode := map[any]any{
+		"x": int64(3),
+		"explode": func() (int64, error) {
+			return 0, fmt.Errorf("explode called")
+		},
+	}
+	checkResult(`x > 2 ? "big" : explode()`, explode, "big")
+	checkResult(`x > 5 ? explode() : "small"`, explode, "small")
+	checkResult(`x > 5 ? 1 : x > 2 ? 2 : 3`, explode, int64(2))
+	checkResult(`(x < 5 ? 1 : 2) + 1`, explode, int64(2))
+	checkResult(`false or x == 3 ? [1] : [2]`, explode, []any{int64(1)})
+	checkResult(`{"k": x > 1 ? "a" : "b"}`, explode, map[any]any{"k": "a"})
+	checkResult(`if x > 2 then "big" else explode()`, explode, "big")
+	checkResult(`if x > 5 then 1 else if x > 2 then 2 else 3`, explode, int64(2))
+	checkResult(`if(x>5)then(1)else(2)`, explode, int64(2))
+	checkResult(`ifx`, map[any]any{"ifx": true}, true)
+
+	checkResult(`2 in [1, 2, 3]`, emptyEnv, true)
+	checkResult(`2.0 in [1, 2, 3]`, emptyEnv, true)
+	checkResult(`"x" in ["a", "b"]`, emptyEnv, false)
+	checkResult(`[1] in [[1], [2]]`, emptyEnv, true)
+	checkResult(`20 in ids`, indexEnv, true)
+	checkResult(`3 in small`, indexEnv, true)
+	checkResult(`4 in small`, indexEnv, false)
+	checkResult(`small == [1, 2, 3]`, indexEnv, true)
+	checkResult(`[1, 2, 3] != small`, indexEnv, false)
+	checkResult(`[0] + small + ids`, indexEnv, []any{int64(0), int64(1), int64(2), int64(3), int64(10), int64(20), int64(30)})
+	checkResult(`"eu" in limits`, indexEnv, true)
+	checkResult(`"ap" in limits`, indexEnv, false)
+	checkResult(`404 in codes`, indexEnv, true)
+	checkResult(`"k" in {"k": 1}`, emptyEnv, true)
+	checkResult(`"ell" in "hello"`, emptyEnv, true)
+	checkResult(`"ll" in word`, indexEnv, true)
+	checkResult(`raw in raw`, indexEnv, true)
+	checkResult(`not ("z" in "hello")`, emptyEnv, true)
+	checkResult(`1 + 1 in [2] and true`, emptyEnv, true)
+	checkResult(`x in [1, 2]`, map[any]any{
+		"x": int64(5),
+		OpIn: func(env map[any]any, a, b any) (any, error) {
+			return true, nil
+		},
+	}, true)
+
+	checkResult("7 % 3", emptyEnv, int64(1))
+	checkResult("-7 % 3", emptyEnv, int64(2))
+	checkResult("7 % -3", emptyEnv, int64(-2))
+	checkResult("7 // 2", emptyEnv, int64(3))
+	checkResult("-7 // 2", emptyEnv, int64(-4))
+	checkResult("7.5 % 2", emptyEnv, 1.5)
+	checkResult("-1 % 2.5", emptyEnv, 1.5)
+	checkResult("7.5 // 2", emptyEnv, float64(3))
+	checkResult("1 + 7 // 2 * 2", emptyEnv, int64(7))
+	checkResult("t % 15m", map[any]any{"t": 47 * time.Minute}, 2*time.Minute)
+	checkResult("t // 15m", map[any]any{"t": 47 * time.Minute}, int64(3))
+	checkResult("t // 2", map[any]any{"t": 47 * time.Minute}, 23*time.Minute+30*time.Second)
+
+	checkResult("12 & 10", emptyEnv, int64(8))
+	checkResult("12 | 3", emptyEnv, int64(15))
+	checkResult("12 xor 10", emptyEnv, int64(6))
+	checkResult("~0", emptyEnv, int64(-1))
+	checkResult("1 << 4", emptyEnv, int64(16))
+	checkResult("-16 >> 2", emptyEnv, int64(-4))
+	checkResult("1 | 2 xor 3 & 6", emptyEnv, int64(1|(2^(3&6))))
+	checkResult("1 << 2 + 1", emptyEnv, int64(8))
+	checkResult("flags & 4 == 4 && flags | 1 != 0", map[any]any{"flags": int64(5)}, true)
+	checkResult("2 ^ 3", emptyEnv, float64(8))
+	checkResult("raw & mask", map[any]any{"raw": []byte{0xde, 0xad}, "mask": []byte{0xf0, 0x0f}}, []byte{0xd0, 0x0d})
+	checkResult("raw | mask", map[any]any{"raw": []byte{0xde, 0xad}, "mask": []byte{0xf0, 0x0f}}, []byte{0xfe, 0xaf})
+	checkResult("1 ~= 2", emptyEnv, true)
+
+	lookups := 0
+	lazyEnv := map[any]any{
+		"has_data": false,
+		"lookup": func() bool {
+			lookups++
+			return true
+		},
+		"explode": func() (bool, error) {
+			return false, fmt.Errorf("explode called")
+		},
+	}
+	checkResult("has_data && lookup()", lazyEnv, false)
+	checkResult("not has_data || lookup()", lazyEnv, true)
+	if lookups != 0 {
+		t.Fatal("logical operators didn't short-circuit")
+	}
+	checkResult("has_data || lookup()", lazyEnv, true)
+	if lookups != 1 {
+		t.Fatal("logical operators skipped the right side")
+	}
+	checkResult("explode() && false", lazyEnv, false)
+	checkResult("explode() || true", lazyEnv, true)
+	checkResult("1 && false", lazyEnv, false)
+	checkResult("true and (false or true)", lazyEnv, true)
+	checkResult("has_data && lookup()", map[any]any{
+		"has_data": false,
+		"lookup":   func() bool { return true },
+		OpAnd: func(env map[any]any, a, b any) (any, error) {
+			return a.(bool) || b.(bool), nil
+		},
+	}, true)
+
+	checkResult("0xFF", emptyEnv, int64(255))
+	checkResult("0Xff + 1", emptyEnv, int64(256))
+	checkResult("0b1010", emptyEnv, int64(10))
+	checkResult("0o755", emptyEnv, int64(0755))
+	checkResult("1_000_000", emptyEnv, int64(1000000))
+	checkResult("0x_dead_beef", emptyEnv, int64(0xdeadbeef))
+	checkResult("1e-9", emptyEnv, 1e-9)
+	checkResult("6.02e23", emptyEnv, 6.02e23)
+	checkResult("1E+3", emptyEnv, float64(1000))
+	checkResult(".5", emptyEnv, 0.5)
+	checkResult("1.5h", emptyEnv, 90*time.Minute)
+	checkResult("5us", emptyEnv, 5*time.Microsecond)
+	checkResult("5u", emptyEnv, uint64(5))
+	checkResult("0xFFFFFFFFFFFFFFFFu", emptyEnv, uint64(math.MaxUint64))
+	checkResult("3u + 4U", emptyEnv, uint64(7))
+	checkResult("7u // 2u", emptyEnv, uint64(3))
+	checkResult("0xF0u | 0x0Fu", emptyEnv, uint64(0xff))
+	checkResult("1u < 2 && 2.5 > 2u && -1 < 0u", emptyEnv, true)
+	checkResult("1u == 1", emptyEnv, true)
+	checkResult(`"n" + 1u`, emptyEnv, "n1")
+	checkResult("0xFF & 0b1111 == 0o17", emptyEnv, true)
+
+	checkResult(`'single' + "double"`, emptyEnv, "singledouble")
+	checkResult(`'it\'s "quoted"'`, emptyEnv, `it's "quoted"`)
+	checkResult(`r"\d+\.\w"`, emptyEnv, `\d+\.\w`)
+	checkResult(`R'\n'`, emptyEnv, `\n`)
+	checkResult("`raw\\n`", emptyEnv, `raw\n`)
+	checkResult(`"""line one
+line "two"!"""`, emptyEnv, "line one\nline \"two\"!")
+	checkResult(`'''a
+'b'
+'''`, emptyEnv, "a\n'b'\n")
+	checkResult(`r"""\d
+"""`, emptyEnv, "\\d\n")
+	checkResult(`"\a\b\f\n\r\t\v\\\'\"\?\`+"`"+`"`, emptyEnv, "\a\b\f\n\r\t\v\\'\"?`")
+	checkResult(`"\x41\u00e9\U0001F600\101\377"`, emptyEnv, "A\u00e9\U0001F600A\u00ff")
+	checkResult(`"é" == "\u00E9"`, emptyEnv, true)
+	checkResult(`r`, map[any]any{"r": "ident"}, "ident")
+
+	checkResult(`b"abc"`, emptyEnv, []byte("abc"))
+	checkResult(`B'\xde\xad\377é'`, emptyEnv, []byte{0xde, 0xad, 0xff, 0xc3, 0xa9})
+	checkResult(`br"\x00" == rb'\x00'`, emptyEnv, true)
+	checkResult(`Rb"\d"`, emptyEnv, []byte(`\d`))
+	checkResult(`x"deadBEEF"`, emptyEnv, []byte{0xde, 0xad, 0xbe, 0xef})
+	checkResult(`X''`, emptyEnv, []byte{})
+	checkResult(`sig == x"dead"`, map[any]any{"sig": []byte{0xde, 0xad}}, true)
+	checkResult(`b"ab" + b"c"`, emptyEnv, []byte("abc"))
+	checkResult(`x"ff00" & x"0ff0"`, emptyEnv, []byte{0x0f, 0x00})
+	checkResult(`b"ell" in b"hello"`, emptyEnv, true)
+	checkResult(`[b, x, rb]`, map[any]any{"b": "b", "x": "x", "rb": "rb"}, []any{"b", "x", "rb"})
+
+	calls := 0
+	macroEnv := map[any]any{
+		"items": []map[string]any{
+			{"name": "a", "size": int64(3)},
+			{"name": "b", "size": int64(0)},
+			{"name": "c", "size": int64(5)},
+		},
+		"ids":    []int64{10, 20, 30},
+		"limits": map[string]int64{"us": 10, "eu": 20},
+		"i":      "outer",
+		"check": func(x int64) bool {
+			calls++
+			return x > 10
+		},
+	}
+	checkResult(`items.all(i, i.size > 0)`, macroEnv, false)
+	checkResult(`items.exists(i, i.size > 4)`, macroEnv, true)
+	checkResult(`items.exists_one(i, i.size == 0)`, macroEnv, true)
+	checkResult(`items.exists_one(i, i.size > 0)`, macroEnv, false)
+	checkResult(`items.filter(i, i.size > 0).map(i, i.name)`, macroEnv, []any{"a", "c"})
+	checkResult(`items.map(i, i.size > 0, i.size * 2)`, macroEnv, []any{int64(6), int64(10)})
+	checkResult(`ids.map(x, ids.map(y, x + y))`, macroEnv, []any{
+		[]any{int64(20), int64(30), int64(40)},
+		[]any{int64(30), int64(40), int64(50)},
+		[]any{int64(40), int64(50), int64(60)},
+	})
+	checkResult(`limits.all(k, k in ["us", "eu"])`, macroEnv, true)
+	checkResult(`[1, 2, 3].exists(x, x == 2) and [].all(x, false) and not [].exists(x, true)`, macroEnv, true)
+	checkResult(`x"0102".map(b, b + 1)`, macroEnv, []any{int64(2), int64(3)})
+	checkResult(`ids.map(i, i)[0] + ids[0]`, macroEnv, int64(20))
+	checkResult(`[ids.all(i, i > 0), i]`, macroEnv, []any{true, "outer"})
+	checkResult(`ids.exists(x, check(x))`, macroEnv, true)
+	if calls != 2 {
+		t.Fatalf("exists didn't short-circuit: %d calls", calls)
+	}
+	checkResult(`ids.all(x, check(x))`, macroEnv, false)
+	if calls != 3 {
+		t.Fatalf("all didn't short-circuit: %d calls", calls)
+	}
+	if _, ok := macroEnv["x"]; ok {
+		t.Fatal("comprehension modified the environment")
+	}
+
+	evaluations := 0
+	letEnv := map[any]any{
+		"x": int64(4),
+		"expensive": func(a int64) int64 {
+			evaluations++
+			return a * 10
+		},
+	}
+	checkResult(`let y = expensive(x) in y + y`, letEnv, int64(80))
+	if evaluations != 1 {
+		t.Fatalf("let binding evaluated %d times", evaluations)
+	}
+	checkResult(`let a = 1, b = a + 1, a = b * 10 in a + b`, letEnv, int64(22))
+	checkResult(`let x = x + 1 in x`, letEnv, int64(5))
+	checkResult(`(let x = 1 in x) + x`, letEnv, int64(5))
+	checkResult(`let l = [1, 2], found = 2 in found in l`, letEnv, true)
+	checkResult(`let found = (2 in [1, 2]), l = [x in [4]] in found and l[0]`, letEnv, true)
+	checkResult(`let m = {"k": x in [4]} in m.k`, letEnv, true)
+	checkResult(`let y = x > 3 ? "big" : "small" in y`, letEnv, "big")
+
+	scaledEnv := map[any]any{
+		"scale": int64(3),
+		OpMul: func(env map[any]any, a, b any) (any, error) {
+			scale, _ := Lookup(env, "scale")
+			return a.(int64) * b.(int64) * scale.(int64), nil
+		},
+		ModFormat: func(env map[any]any, a any) (any, error) {
+			unit, _ := Lookup(env, "unit")
+			return fmt.Sprintf("%v%v", a, unit), nil
+		},
+	}
+	checkResult(`let y = 2 in y * 1`, scaledEnv, int64(6))
+	checkResult(`[1, 2].map(i, i * 1)`, scaledEnv, []any{int64(3), int64(6)})
+	checkResult(`((a) => a * 2)(1)`, scaledEnv, int64(6))
+	checkResult(`let unit = "m" in [1].map(i, f"{i}")`, scaledEnv, []any{"1m"})
+	checkResult(`let a = 1 in let b = a + 1 in a + b`, letEnv, int64(3))
+	checkResult(`[1, 2].map(i, let d = i * 2 in d + x)`, letEnv, []any{int64(6), int64(8)})
+	checkResult(`letter`, map[any]any{"letter": "a"}, "a")
+	if x := letEnv["x"]; x != int64(4) {
+		t.Fatal("let modified the environment")
+	}
+
+	lambdaEnv := map[any]any{
+		"x": int64(4),
+		"sort_by": func(items []any, key func(any) (int64, error)) ([]any, error) {
+			keys := make([]int64, len(items))
+			for i, item := range items {
+				k, err := key(item)
+				if err != nil {
+					return nil, err
+				}
+				keys[i] = k
+			}
+			sorted := append([]any(nil), items...)
+			sort.Sort(byKey{sorted, keys})
+			return sorted, nil
+		},
+		"apply": func(f func(int64) (int64, error), a int64) (int64, error) {
+			return f(a)
+		},
+	}
+	checkResult(`((a, b) => a + b)(1, 2)`, lambdaEnv, int64(3))
+	checkResult(`(() => x)()`, lambdaEnv, int64(4))
+	checkResult(`( ( a ) => a * 2 )(x)`, lambdaEnv, int64(8))
+	checkResult(`sort_by([{"p": 2}, {"p": 1}], (i) => i.p)`, lambdaEnv,
+		[]any{map[any]any{"p": int64(1)}, map[any]any{"p": int64(2)}})
+	checkResult(`let x = 10 in apply((a) => a + x, 1)`, lambdaEnv, int64(11))
+	checkResult(`let f = (a) => a + x in let x = 100 in f(1)`, lambdaEnv, int64(5))
+	checkResult(`[1, 2].map(i, ((a) => a * i)(x))`, lambdaEnv, []any{int64(4), int64(8)})
+	checkResult(`(x) + 1`, lambdaEnv, int64(5))
+
+	var noSite *testSite
+	nullEnv := map[any]any{
+		"site":    site,
+		"missing": noSite,
+		"meta":    map[string]any(nil),
+		"tags":    []string(nil),
+		"first": func(items []string) any {
+			if len(items) == 0 {
+				return nil
+			}
+			return items[0]
+		},
+		"or_default": func(s *testSite, d string) string {
+			if s == nil {
+				return d
+			}
+			return s.Name
+		},
+	}
+	checkResult(`null`, nullEnv, nil)
+	checkResult(`null == null`, nullEnv, true)
+	checkResult(`missing == null`, nullEnv, true)
+	checkResult(`meta == null`, nullEnv, true)
+	checkResult(`site != null`, nullEnv, true)
+	checkResult(`tags == null`, nullEnv, false)
+	checkResult(`first(tags) == null`, nullEnv, true)
+	checkResult(`0 == null`, nullEnv, false)
+	checkResult(`[null] == [null]`, nullEnv, true)
+	checkResult(`missing?.Name`, nullEnv, nil)
+	checkResult(`missing?.climate.tmin_avg_min_2050`, nullEnv, nil)
+	checkResult(`missing?.Describe("at ")`, nullEnv, nil)
+	checkResult(`site?.Name`, nullEnv, "ridge")
+	checkResult(`meta?.["region"]`, nullEnv, nil)
+	checkResult(`meta?.["region"].name`, nullEnv, nil)
+	checkResult(`site?.["Name"]`, map[any]any{"site": map[string]any{"Name": "ridge"}}, "ridge")
+	checkResult(`missing?.Describe?.("at ")`, nullEnv, nil)
+	checkResult(`null?.all(i, true)`, nullEnv, nil)
+	checkResult(`meta?.map(k, k)`, nullEnv, nil)
+	checkResult(`missing?.tags.filter(t, true)`, nullEnv, nil)
+	checkResult(`tags?.map(t, t)`, nullEnv, []any{})
+	checkResult(`flag?[1]:[2]`, map[any]any{"flag": false}, []any{int64(2)})
+	checkResult(`flag?[1]:[2]`, map[any]any{"flag": true}, []any{int64(1)})
+	checkResult(`missing?.Name ?? "unknown"`, nullEnv, "unknown")
+	checkResult(`site?.Name ?? explode()`, nullEnv, "ridge")
+	checkResult(`null ?? null ?? 1`, nullEnv, int64(1))
+	checkResult(`or_default(missing, "none")`, nullEnv, "none")
+	checkResult(`or_default(null, "none")`, nullEnv, "none")
+	checkResult(`missing == null ? 1 : 2`, nullEnv, int64(1))
+	checkResult(`site?.elevation > 1 ?.5:1`, nullEnv, 0.5)
+
+	methodEnv := map[any]any{
+		"site":       site,
+		"name":       "Alder",
+		"lower":      func(s string) string { return strings.ToLower(s) },
+		"startsWith": func(s, prefix string) bool { return strings.HasPrefix(s, prefix) },
+		"join":       func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"Describe":   func(s *testSite, prefix string) string { return "shadowed" },
+		"helpers":    map[string]any{"twice": func(a int64) int64 { return a * 2 }},
+	}
+	checkResult(`name.lower().startsWith("a")`, methodEnv, true)
+	checkResult(`"-".join("a", name.lower())`, methodEnv, "a-alder")
+	checkResult(`site.Describe("at ")`, methodEnv, "ridge at 4200")
+	checkResult(`site.Name.lower()`, methodEnv, "ridge")
+	checkResult(`helpers.twice(2)`, methodEnv, int64(4))
+	checkResult(`let double = (a) => a * 2 in 3.0.double()`, methodEnv, float64(6))
+
 	checkResult("2h", emptyEnv, 2*time.Hour)
 	checkResult("2s == 2 * (1s)", emptyEnv, true)
+	newYear := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	checkResult(`t"2025-01-01T00:00:00Z"`, emptyEnv, newYear)
+	checkResult(`t'2024-01-02T03:04:05.5-07:00'`, emptyEnv,
+		time.Date(2024, 1, 2, 3, 4, 5, 5e8, time.FixedZone("", -7*60*60)))
+	checkResult(`created < t"2025-01-01T00:00:00Z"`, map[any]any{"created": newYear.Add(-time.Second)}, true)
+	checkResult(`t"2025-01-01T00:00:00Z" + 1h`, emptyEnv, newYear.Add(time.Hour))
+	checkResult(`t"2025-01-01T01:00:00+01:00" == date(2025, 1, 1)`, emptyEnv, true)
+	checkResult(`timestamp("2025-01-01T00:00:00Z") - date(2024, 12, 31)`, emptyEnv, 24*time.Hour)
+	checkResult(`duration("1h30m") == 1h30m`, emptyEnv, true)
+	checkResult(`t`, map[any]any{"t": "ident"}, "ident")
+	checkResult("1h30m", emptyEnv, 90*time.Minute)
+	checkResult("2m30s + 1h1.5s", emptyEnv, time.Hour+2*time.Minute+31500*time.Millisecond)
+	checkResult("1h2m3s4ms5us6ns", emptyEnv, time.Hour+2*time.Minute+3*time.Second+4*time.Millisecond+5*time.Microsecond+6)
+	checkResult("-1h30m", emptyEnv, -90*time.Minute)
+	checkResult("2h - -1h30m", emptyEnv, 210*time.Minute)
+	checkResult("-1h30m.Minutes()", emptyEnv, float64(-90))
+	checkResult("-2 ^ 2", emptyEnv, float64(-4))
+	checkResult("(-1h30m).Minutes()", emptyEnv, float64(-90))
+	checkResult("-x.Minutes() == -1h30m.Minutes()", map[any]any{"x": 90 * time.Minute}, true)
+	checkResult("- 1h * 2", emptyEnv, -2*time.Hour)
+	checkResult("-1h30m", map[any]any{
+		ModNeg: func(env map[any]any, a any) (any, error) {
+			return nil, fmt.Errorf("negative literals shouldn't negate")
+		},
+	}, -90*time.Minute)
 
 	checkResult("#\n3", emptyEnv, int64(3))
 
+	middleCalls := 0
+	chainEnv := map[any]any{
+		"x": int64(5),
+		"middle": func() int64 {
+			middleCalls++
+			return 5
+		},
+	}
+	checkResult("1 < x < 10", chainEnv, true)
+	checkResult("1 < x < 3", chainEnv, false)
+	checkResult("10 > x >= 5 == true", chainEnv, true)
+	checkResult("1 < 2 < 3 < 4 != 5", chainEnv, true)
+	checkResult("1 < middle() <= 5", chainEnv, true)
+	if middleCalls != 1 {
+		t.Fatalf("middle operand evaluated %d times", middleCalls)
+	}
+	checkResult("3 < 1 < middle()", chainEnv, false)
+	if middleCalls != 1 {
+		t.Fatal("chained comparison didn't short-circuit")
+	}
+	checkResult("(1 < 2) == true", chainEnv, true)
+	checkResult("1 < 2 == true", chainEnv, true)
+	checkResult("x > 5 == flag", map[any]any{"x": int64(6), "flag": true}, true)
+	checkResult("x > 5 != flag", map[any]any{"x": int64(6), "flag": true}, false)
+	checkResult("1 < x in [true]", chainEnv, true)
+	checkResult("1 < x < 10 == true", chainEnv, true)
+	checkResult(`"a" =~ "a" == true`, chainEnv, true)
+	checkResult("0 < x < 10 and x != 7", chainEnv, true)
+
+	pipeEnv := map[any]any{
+		"x":     int64(7),
+		"name":  "Alder",
+		"scale": func(a, b int64) int64 { return a * b },
+		"clamp": func(a, lo, hi int64) int64 {
+			if a < lo {
+				return lo
+			}
+			if a > hi {
+				return hi
+			}
+			return a
+		},
+		"neg":   func(a int64) int64 { return -a },
+		"lower": func(s string) string { return strings.ToLower(s) },
+	}
+	checkResult(`x |> scale(2) |> clamp(0, 10)`, pipeEnv, int64(10))
+	checkResult(`x |> neg`, pipeEnv, int64(-7))
+	checkResult(`x + 1 |> neg()`, pipeEnv, int64(-8))
+	checkResult(`x |> ((a) => a * 3)`, pipeEnv, int64(21))
+	checkResult(`x > 5 ? 1 : 2 |> neg`, pipeEnv, int64(1))
+	checkResult(`x < 5 ? 1 : 2 |> neg`, pipeEnv, int64(-2))
+	checkResult(`(x |> neg) + 1`, pipeEnv, int64(-6))
+	checkResult(`name |> lower() |> matches("^al")`, pipeEnv, true)
+	checkResult(`x | 8 > 1`, pipeEnv, true)
+
+	fmtEnv := map[any]any{"name": "alder", "count": int64(3), "site": site}
+	checkResult(`f"user {name} has {count} items"`, fmtEnv, "user alder has 3 items")
+	checkResult(`f'{count * 2}{"!"}'`, fmtEnv, "6!")
+	checkResult(`f"{site.Name}: {site.elevation > 4000 ? "high" : "low"}"`, fmtEnv, "ridge: high")
+	checkResult(`f"{{literal}} {{{count}}}"`, fmtEnv, "{literal} {3}")
+	checkResult(`f"\t{null} {1.5} {[1, 2]} { {"k": 1}.k }"`, fmtEnv, "\tnull 1.5 [1 2] 1")
+	checkResult(`f"{t"2025-01-02T03:04:05Z"} {90m}"`, fmtEnv, "2025-01-02T03:04:05Z 1h30m0s")
+	checkResult(`f""`, fmtEnv, "")
+	checkResult(`f"""a "{name}"
+b"""`, fmtEnv, "a \"alder\"\nb")
+	checkResult(`f"""{count +
+	1}"""`, fmtEnv, "4")
+	checkResult(`f"{count}" + "!"`, map[any]any{
+		"count": int64(3),
+		ModFormat: func(env map[any]any, a any) (any, error) {
+			return fmt.Sprintf("<%v>", a), nil
+		},
+	}, "<3>!")
+
+	matchEnv := map[any]any{"limits": []int64{5, 6}, "x": int64(4)}
+	classify := `match v {
+		case 1, 2 => "low",
+		case in limits => "limit",
+		case "a", null => "other",
+		case n if n > 10 => f"high {n}",
+		_ => "mid",
+	}`
+	for v, expected := range map[any]string{
+		int64(1): "low", int64(2): "low", int64(6): "limit", int64(11): "high 11", int64(7): "mid", "a": "other", nil: "other",
+	} {
+		checkResult(classify, map[any]any{"v": v, "limits": []int64{5, 6}}, expected)
+	}
+	checkResult(`match x { case 4 if false => 1, case 4 => 2 } + 1`, matchEnv, int64(3))
+	checkResult(`match x + 1 {case x => x, _ => 0}`, matchEnv, int64(0))
+	checkResult(`match x { case n if n in limits => 1, case y if y == x => y * 2 }`, matchEnv, int64(8))
+	checkResult(`[3, 4].map(i, match i { case 3 => "three", _ => i })`, matchEnv, []any{"three", int64(4)})
+	checkResult(`match [1] { case [1] => true }`, matchEnv, true)
+	checkResult(`match x { case (x) => 1, _ => 2 }`, matchEnv, int64(1))
+	checkResult(`match x { case (3) => 1, case in (limits) => 2, case n if (n > 3) => 3 }`, matchEnv, int64(3))
+	checkResult(`match x { case ((y) => y)(4) => "lambda", _ => "none" }`, matchEnv, "lambda")
+	checkResult(`matches`, map[any]any{"matches": true}, true)
+
+	rangeEnv := map[any]any{
+		"elevation": int64(8000),
+		"when":      time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+		"lo":        int64(2),
+	}
+	checkResult(`elevation in 100..8000`, rangeEnv, true)
+	checkResult(`elevation in 100..<8000`, rangeEnv, false)
+	checkResult(`elevation in 8000.5..9000`, rangeEnv, false)
+	checkResult(`7.5 in 1..10`, rangeEnv, true)
+	checkResult(`90m in 1h..2h`, rangeEnv, true)
+	checkResult(`-30m in -1h30m..0s`, rangeEnv, true)
+	checkResult(`when in t"2025-01-01T00:00:00Z"..<t"2026-01-01T00:00:00Z"`, rangeEnv, true)
+	checkResult(`when in date(2024, 1, 1)..date(2024, 12, 31)`, rangeEnv, false)
+	checkResult(`(1..5).map(i, i * i)`, rangeEnv, []any{int64(1), int64(4), int64(9), int64(16), int64(25)})
+	checkResult(`(lo..<lo + 3).filter(i, i % 2 == 0)`, rangeEnv, []any{int64(2), int64(4)})
+	checkResult(`(1..<1).exists(i, true)`, rangeEnv, false)
+	checkResult(`(3..1).map(i, i)`, rangeEnv, []any{})
+	checkResult(`1 + 1 .. 2 * 3`, rangeEnv, Range{Start: int64(2), End: int64(6)})
+	checkResult(`lo..lo in [1..2]`, rangeEnv, false)
+	checkResult(`1..lo == 1..2 and 1..2 != 1..<2 and 1..2 != [1, 2]`, rangeEnv, true)
+	checkResult(`(9223372036854775806..9223372036854775807).map(i, i - 9223372036854775806)`, rangeEnv, []any{int64(0), int64(1)})
+	checkResult(`(1..10000).filter(i, i == 10000)`, rangeEnv, []any{int64(10000)})
+	checkResult(`elevation >= 100 and elevation in 100..8000`, rangeEnv, true)
+
+	regexEnv := map[any]any{"name": "Alder", "pattern": "^[a-z]+$"}
+	checkResult(`name =~ "^A"`, regexEnv, true)
+	checkResult(`name =~ r"\d"`, regexEnv, false)
+	checkResult(`name !~ "^a"`, regexEnv, true)
+	checkResult(`"alder" =~ pattern`, regexEnv, true)
+	checkResult(`name =~ pattern`, regexEnv, false)
+	checkResult(`matches(name, "d[a-z]r$")`, regexEnv, true)
+	checkResult(`name.matches("^B") or "b" =~ "B|b"`, regexEnv, true)
+	globEnv := map[any]any{
+		"matches": func(s, glob string) bool {
+			ok, _ := path.Match(glob, s)
+			return ok
+		},
+		OpMatch: func(env map[any]any, a, b any) (any, error) {
+			return strings.HasPrefix(a.(string), b.(string)), nil
+		},
+	}
+	checkResult(`matches("abc", "abc") and matches("(", "(") and "abc".matches("a*")`, globEnv, true)
+	checkResult(`"abc" =~ "ab"`, globEnv, true)
+
 	checkResult(
 		`(
 	# Elevation (ft)
@@ -138,6 +754,433 @@ func testRun(t testing.TB, inputcb func(string)) {
 		},
 		true)
 
+	checkResult(
+		`100 <= elevation <= 8000 and tmin_avg_min_2050 >= -6`,
+		map[any]any{"elevation": int64(101), "tmin_avg_min_2050": int64(-5)},
+		true)
+	checkResult(
+		`100 <= elevation <= 8000 and tmin_avg_min_2050 >= -6`,
+		map[any]any{"elevation": int64(8001), "tmin_avg_min_2050": int64(-5)},
+		false)
+}
+
+// byKey sorts items by the matching keys.
+type byKey struct {
+	items []any
+	keys  []int64
+}
+
+func (b byKey) Len() int           { return len(b.items) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.items[i], b.items[j] = b.items[j], b.items[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+type testClimate struct {
+	TminAvgMin2050 int64 `mito:"tmin_avg_min_2050"`
+}
+
+type testSite struct {
+	Name      string
+	Elevation int64       `mito:"elevation"`
+	Climate   testClimate `mito:"climate"`
+	Secret    string      `mito:"-"`
+}
+
+func (s *testSite) Describe(prefix string) string {
+	return s.Name + " " + prefix + fmt.Sprint(s.Elevation)
+}
+
+func TestSelectErrors(t *testing.T) {
+	env := map[any]any{
+		"site": &testSite{},
+		"meta": map[string]any{},
+		"none": (*testSite)(nil),
+	}
+	for _, input := range []string{"site.Secret", "site.secret", "site.Elevation", "meta.missing", "none.Name"} {
+		if _, err := Eval(input, env); err == nil {
+			t.Fatalf("expected error for %#v", input)
+		}
+	}
+	if _, err := Eval("site.missing", env); !errors.Is(err, ErrUnknownField) {
+		t.Fatalf("expected unknown field, got %v", err)
+	}
+	if _, err := Parse("site.1"); !errors.Is(err, ErrParser) {
+		t.Fatalf("expected parser error, got %v", err)
+	}
+}
+
+func TestIndexErrors(t *testing.T) {
+	env := map[any]any{
+		"ids":    []int64{10, 20, 30},
+		"limits": map[string]int64{"us": 10},
+		"word":   "héllo",
+		"raw":    []byte{0xde, 0xad},
+	}
+	for _, input := range []string{"ids[3]", "ids[-1]", "word[5]", "raw[2]"} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrIndexOutOfRange) {
+			t.Fatalf("expected out of range error for %#v, got %v", input, err)
+		}
+	}
+	if _, err := Eval(`limits["eu"]`, env); !errors.Is(err, ErrMissingKey) || !errors.Is(err, ErrValueMismatch) {
+		t.Fatalf("expected missing key error, got %v", err)
+	}
+	for _, input := range []string{`ids["a"]`, `limits[1]`, `true[0]`} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestMapErrors(t *testing.T) {
+	if _, err := Parse(`{"a": 1, "b": 2, "a": 3}`); !errors.Is(err, ErrParser) {
+		t.Fatalf("expected parser error, got %v", err)
+	}
+	if _, err := Eval(`{k: 1, "a": 2}`, map[any]any{"k": "a"}); !errors.Is(err, ErrValueMismatch) {
+		t.Fatalf("expected value mismatch, got %v", err)
+	}
+	if _, err := Eval(`{[1]: 2}`, map[any]any{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+}
+
+func TestConditionalErrors(t *testing.T) {
+	if _, err := Eval(`1 ? 2 : 3`, map[any]any{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+	for _, input := range []string{`true ? 1`, `if true then 1`, `if true 1 else 2`, `then`} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestModFloorDivErrors(t *testing.T) {
+	for _, input := range []string{"1 % 0", "1 // 0", "1.5 % 0.0", "1s // 0s", "1s % 0s"} {
+		if _, err := Eval(input, map[any]any{}); !errors.Is(err, ErrValueMismatch) {
+			t.Fatalf("expected division by zero for %#v, got %v", input, err)
+		}
+	}
+	if _, err := Eval(`"a" % 2`, map[any]any{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+}
+
+func TestBitwiseErrors(t *testing.T) {
+	env := map[any]any{"raw": []byte{1, 2}, "short": []byte{1}}
+	for _, input := range []string{"1 << -1", "raw & short", "raw | short"} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrValueMismatch) {
+			t.Fatalf("expected value mismatch for %#v, got %v", input, err)
+		}
+	}
+	for _, input := range []string{"1.5 & 1", "~1.5", "raw xor raw", "true | false"} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestLogicalErrors(t *testing.T) {
+	env := map[any]any{
+		"explode": func() (bool, error) {
+			return false, fmt.Errorf("explode called")
+		},
+	}
+	for _, input := range []string{"explode() && true", "true && explode()", "explode() || false", "false || explode()"} {
+		if _, err := Eval(input, env); err == nil {
+			t.Fatalf("expected error for %#v", input)
+		}
+	}
+	for _, input := range []string{"1 && true", "false || 1"} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestNumberErrors(t *testing.T) {
+	for _, input := range []string{
+		"0x", "0b102", "0o8", "1__0", "1_", "12abc", "0xFFg", "1.5u",
+		"1e", "1.2.3", "99999999999999999999", "0x1_0000_0000_0000_0000u", "1e5s",
+	} {
+		_, err := Parse(input)
+		if !errors.Is(err, ErrParser) || !strings.Contains(err.Error(), "malformed number") {
+			t.Fatalf("expected malformed number error for %#v, got %v", input, err)
+		}
+	}
+	if _, err := Eval("1u + 1", map[any]any{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+}
+
+func TestExtendedDurations(t *testing.T) {
+	for input, expected := range map[string]time.Duration{
+		"1d":      24 * time.Hour,
+		"2w3d12h": 17*24*time.Hour + 12*time.Hour,
+		"1.5d":    36 * time.Hour,
+		"-1w":     -7 * 24 * time.Hour,
+	} {
+		p := NewParser(input)
+		p.ExtendedDurations = true
+		expr, err := p.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := expr.Run(map[any]any{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != expected {
+			t.Fatalf("input %#v expected %v, got %v", input, expected, val)
+		}
+	}
+	for _, input := range []string{"1d", "1h2", "1h2x", "1h1e3s", "1h0x1s", "99999999w", "2562047h1h"} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestNegativeDurationErrors(t *testing.T) {
+	if _, err := Eval("-1h ^ 2", map[any]any{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+}
+
+func TestTimeErrors(t *testing.T) {
+	for _, input := range []string{`t"2025-01-01"`, `t"yesterday"`, `t"2025-13-01T00:00:00Z"`} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+	for _, input := range []string{`timestamp("2025")`, `date(2025, 2, 30)`, `date(2025, 0, 1)`, `duration("1d")`} {
+		if _, err := Eval(input, map[any]any{}); !errors.Is(err, ErrValueMismatch) {
+			t.Fatalf("expected value mismatch for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestComprehensionErrors(t *testing.T) {
+	for _, input := range []string{`[1].all(1, true)`, `[1].all(x)`, `[1].map(x, true, x, x)`, `[1].filter(x.y, true)`} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+	for _, input := range []string{`[1].all(x, x)`, `1.5.exists(x, true)`, `"abc".all(x, true)`} {
+		if _, err := Eval(input, map[any]any{}); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+	if _, err := Eval(`[1].map(x, y)`, map[any]any{}); !errors.Is(err, ErrUnboundVar) {
+		t.Fatalf("expected unbound variable, got %v", err)
+	}
+}
+
+func TestLetErrors(t *testing.T) {
+	for _, input := range []string{`let x = 1`, `let x 1 in x`, `let x == 1 in x`, `let 1 = 1 in 1`, `let in = 1 in 1`, `let x = 1 in`, `let x = 1, in x`} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestLambdaErrors(t *testing.T) {
+	for _, input := range []string{`(a) =>`, `(a, 1) => a`, `(a, b`, `(if) => 1`} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+	var stored func(a any) (int64, error)
+	env := map[any]any{
+		"apply":     func(f func(int64) (int64, error)) (int64, error) { return f(1) },
+		"apply_int": func(f func(int64) int64) int64 { return f(1) },
+		"register": func(f func(any) (int64, error)) bool {
+			stored = f
+			return true
+		},
+	}
+	for _, input := range []string{`((a) => a)(1, 2)`, `apply((a, b) => a)`, `apply((a) => "a")`, `apply_int((a) => a)`, `1(2)`} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+	if _, err := Eval(`register((a) => a.missing)`, env); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stored(map[string]any{}); !errors.Is(err, ErrUnknownField) {
+		t.Fatalf("expected unknown field from stored lambda, got %v", err)
+	}
+}
+
+func TestNullErrors(t *testing.T) {
+	var noSite *testSite
+	env := map[any]any{
+		"missing": noSite,
+		"double":  func(a int64) int64 { return a * 2 },
+	}
+	for _, input := range []string{`missing.Name`, `null[0]`, `null()`, `null < 1`, `double(null)`, `missing?.Name + 1`} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestMethodCallErrors(t *testing.T) {
+	env := map[any]any{
+		"site":  &testSite{Name: "ridge"},
+		"lower": func(s string) string { return strings.ToLower(s) },
+	}
+	for _, input := range []string{`site.nope()`, `site.Name()`, `"a".upper()`} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrUnknownField) {
+			t.Fatalf("expected unknown field for %#v, got %v", input, err)
+		}
+	}
+	if _, err := Eval(`1.lower()`, env); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+}
+
+func TestComparisonErrors(t *testing.T) {
+	env := map[any]any{
+		OpLess: func(env map[any]any, a, b any) (any, error) {
+			return "yes", nil
+		},
+	}
+	for _, input := range []string{`1 < 2 < 3`, `1 < "a" < 3`} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestRegexpErrors(t *testing.T) {
+	for _, input := range []string{`"a" =~ "("`, `"a" !~ "[z-a]"`} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) || !strings.Contains(err.Error(), "invalid pattern") {
+			t.Fatalf("expected invalid pattern error for %#v, got %v", input, err)
+		}
+	}
+	env := map[any]any{"pattern": "("}
+	for _, input := range []string{`"a" =~ pattern`, `matches("a", "(")`, `"a".matches("*")`, `"a" |> matches("(")`} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrValueMismatch) {
+			t.Fatalf("expected value mismatch for %#v, got %v", input, err)
+		}
+	}
+	for _, input := range []string{`1 =~ "a"`, `"a" =~ 1`} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+	for i := 0; i < regexpCacheSize*2; i++ {
+		if _, err := matchPattern("a", fmt.Sprintf("a{0,%d}", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(regexpCache.compiled) > regexpCacheSize {
+		t.Fatalf("regexp cache grew to %d", len(regexpCache.compiled))
+	}
+	if result, err := Eval(`"abc" =~ "^a+bc$" and "abd" !~ "^a+bc$"`, env); err != nil || result != true {
+		t.Fatalf("unexpected result %#v, %v", result, err)
+	}
+	if _, ok := regexpCache.compiled["^a+bc$"]; ok {
+		t.Fatal("constant pattern was compiled at evaluation time")
+	}
+}
+
+func TestPipeErrors(t *testing.T) {
+	for _, input := range []string{`1 |>`, `1 |> f() + 1`, `1 |> f(`} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+	if _, err := Eval(`1 |> 2`, map[any]any{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+}
+
+func TestInterpolationErrors(t *testing.T) {
+	for _, input := range []string{`f"{"`, `f"{}"`, `f"}"`, `f"{1 1}"`, `f"abc`, "f\"{1}\n\"", `f"\q"`,
+		`f"{1 # c }"`, "f\"{1 # c\n}\"", "f\"{1 +\n1}\"", "f\"{\n1}\"", `f"""{1 # c }"""`,
+	} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+	env := map[any]any{
+		ModFormat: func(env map[any]any, a any) (any, error) {
+			return a, nil
+		},
+	}
+	if _, err := Eval(`f"{1}"`, env); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+	if _, err := Eval(`f"{x}"`, map[any]any{}); !errors.Is(err, ErrUnboundVar) {
+		t.Fatalf("expected unbound variable, got %v", err)
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	for _, input := range []string{
+		`match 1 {}`, `match {_ => 1}`, `match 1 { 1 => 2 }`, `match 1 { case => 2 }`, `match 1 { case 1 2 }`,
+		`match 1 { case 1 => }`, `match 1 { _ => 1 _ => 2 }`, `match 1 { case x if => 1 }`, `match 1 { case in => 1 }`,
+		`match 1 { _ => 1`, `case`,
+	} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+	p := NewParser("match 1 {\n  case 1 => 2\n} + match 2 { _ => 3 }")
+	if _, err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Warnings) != 1 || !strings.Contains(p.Warnings[0], "line 1, column 1: match has no default arm") {
+		t.Fatalf("unexpected warnings %#v", p.Warnings)
+	}
+	if _, err := Eval(`match 3 { case 1 => 1 }`, map[any]any{}); !errors.Is(err, ErrValueMismatch) {
+		t.Fatalf("expected value mismatch, got %v", err)
+	}
+	if _, err := Eval(`match 1 { case x if 1 => 1 }`, map[any]any{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+}
+
+func TestRangeErrors(t *testing.T) {
+	env := map[any]any{
+		"r": Range{Start: int64(1), End: 2.5},
+		"s": Range{Start: "a", End: int64(2)},
+	}
+	for _, input := range []string{
+		`1.."a"`, `1..1h`, `"a"..<"b"`, `"a" in 1..2`, `1h in 1..2`, `(1.5..2).all(x, true)`, `(1h..2h).map(x, x)`,
+		`r.map(i, i)`, `s.exists(i, true)`,
+	} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected type mismatch for %#v, got %v", input, err)
+		}
+	}
+	for _, input := range []string{
+		`(0..9223372036854775807).exists(i, false)`, `(0..100000000).map(i, i)`, `(0..10000).all(i, true)`,
+		`(-9223372036854775807-1..9223372036854775807).all(i, true)`,
+	} {
+		if _, err := Eval(input, env); !errors.Is(err, ErrValueMismatch) {
+			t.Fatalf("expected value mismatch for %#v, got %v", input, err)
+		}
+	}
+	for _, input := range []string{`1..`, `..1`, `1..<`, `x..y.`} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	for _, input := range []string{
+		`"abc`, "\"a\nb\"", `"\q"`, `"\x4"`, `"\u12"`, `"\uD800"`, `"\U00110000"`, `"\400"`, `"\08"`,
+		`'''abc''`, `"""abc"`, `x"abc"`, `x"zz"`, `b"\u12"`,
+	} {
+		if _, err := Parse(input); !errors.Is(err, ErrParser) {
+			t.Fatalf("expected parser error for %#v, got %v", input, err)
+		}
+	}
 }
 
 func FuzzRun(f *testing.F) {
@@ -0,0 +1,411 @@
+package mito
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// fieldName returns the name a struct field is selectable by, honoring
+// a `mito:"name"` tag. hidden is true if the field should not be
+// selectable at all.
+func fieldName(field reflect.StructField) (name string, hidden bool) {
+	if !field.IsExported() {
+		return "", true
+	}
+	tag, ok := field.Tag.Lookup("mito")
+	if !ok || tag == "" {
+		return field.Name, false
+	}
+	if tag == "-" {
+		return "", true
+	}
+	return tag, false
+}
+
+// selectField resolves name on x, which can be a struct (or pointer to
+// one), a map with string-like keys, or anything with a method called
+// name.
+func selectField(x any, name string) (any, error) {
+	v := reflect.ValueOf(x)
+	if !v.IsValid() {
+		return nil, fmt.Errorf("%w: field %q of nil", ErrTypeMismatch, name)
+	}
+	for {
+		if method := v.MethodByName(name); method.IsValid() {
+			return method.Interface(), nil
+		}
+		if v.Kind() != reflect.Pointer && v.Kind() != reflect.Interface {
+			break
+		}
+		if v.IsNil() {
+			return nil, fmt.Errorf("%w: field %q of nil %s", ErrTypeMismatch, name, v.Type())
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, field := range reflect.VisibleFields(v.Type()) {
+			if field.Anonymous {
+				continue
+			}
+			fname, hidden := fieldName(field)
+			if hidden || fname != name {
+				continue
+			}
+			fv, err := v.FieldByIndexErr(field.Index)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrValueMismatch, err)
+			}
+			return fromGo(fv), nil
+		}
+	case reflect.Map:
+		key, err := convertKey(reflect.ValueOf(name), v.Type().Key())
+		if err != nil {
+			return nil, err
+		}
+		if val := v.MapIndex(key); val.IsValid() {
+			return fromGo(val), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q on %T", ErrUnknownField, name, x)
+}
+
+// isNil returns true if x is null: nil itself, or a nil pointer, map,
+// interface, func or channel. Nil slices are empty lists, not null.
+func isNil(x any) bool {
+	if x == nil {
+		return true
+	}
+	v := reflect.ValueOf(x)
+	return nillable(v.Kind()) && v.Kind() != reflect.Slice && v.IsNil()
+}
+
+// nillable returns true for kinds whose zero value is nil.
+func nillable(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Pointer, reflect.Map, reflect.Interface, reflect.Func, reflect.Chan, reflect.Slice:
+		return true
+	}
+	return false
+}
+
+// isHashable returns true if x can be used as a map key.
+func isHashable(x any) bool {
+	t := reflect.TypeOf(x)
+	return t == nil || t.Comparable()
+}
+
+// convertKey makes key usable as a map key of type keyType.
+func convertKey(key reflect.Value, keyType reflect.Type) (reflect.Value, error) {
+	if !key.IsValid() {
+		if keyType.Kind() != reflect.Interface {
+			return reflect.Value{}, fmt.Errorf("%w: nil key for map key %s", ErrTypeMismatch, keyType)
+		}
+		return reflect.Zero(keyType), nil
+	}
+	if key.Type().AssignableTo(keyType) {
+		if !isHashable(key.Interface()) {
+			return reflect.Value{}, fmt.Errorf("%w: unhashable key type %s", ErrTypeMismatch, key.Type())
+		}
+		return key, nil
+	}
+	if kindClass(key.Kind()) != "" && kindClass(key.Kind()) == kindClass(keyType.Kind()) {
+		converted := key.Convert(keyType)
+		if converted.Convert(key.Type()).Interface() != key.Interface() {
+			return reflect.Value{}, fmt.Errorf("%w: key %v overflows %s", ErrValueMismatch, key, keyType)
+		}
+		return converted, nil
+	}
+	return reflect.Value{}, fmt.Errorf("%w: key type %s for map key %s", ErrTypeMismatch, key.Type(), keyType)
+}
+
+// kindClass groups kinds that can be converted between each other
+// without changing what kind of value they are.
+func kindClass(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "uint"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.String:
+		return "string"
+	}
+	return ""
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// fromGo returns the value of v as one of the types the default operators
+// work with, so that, for instance, an int struct field becomes an int64.
+// Unsigned values become int64s too, unless they're too large, in which
+// case they're uint64s. time.Durations are left alone.
+func fromGo(v reflect.Value) any {
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Type() == durationType {
+		return v.Interface()
+	}
+	switch kindClass(v.Kind()) {
+	case "int":
+		return v.Int()
+	case "uint":
+		if u := v.Uint(); u <= math.MaxInt64 {
+			return int64(u)
+		}
+		return v.Uint()
+	case "float":
+		return v.Float()
+	case "string":
+		return v.String()
+	}
+	if v.Kind() == reflect.Bool {
+		return v.Bool()
+	}
+	return v.Interface()
+}
+
+// isByteSlice returns true for []byte and any named slice of bytes.
+func isByteSlice(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8
+}
+
+// toInt converts an integer index of any integer type to an int.
+func toInt(x any) (int, error) {
+	v := reflect.ValueOf(x)
+	switch kindClass(v.Kind()) {
+	case "int":
+		i := v.Int()
+		if int64(int(i)) != i {
+			return 0, fmt.Errorf("%w: %d", ErrIndexOutOfRange, i)
+		}
+		return int(i), nil
+	case "uint":
+		i := v.Uint()
+		if i > uint64(^uint(0)>>1) {
+			return 0, fmt.Errorf("%w: %d", ErrIndexOutOfRange, i)
+		}
+		return int(i), nil
+	}
+	return 0, fmt.Errorf("%w: integer index expected: %#v", ErrTypeMismatch, x)
+}
+
+// indexValue returns x[index]. See Index.
+func indexValue(x, index any) (any, error) {
+	switch x := x.(type) {
+	case string:
+		i, err := toInt(index)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range x {
+			if i == 0 {
+				return string(r), nil
+			}
+			i--
+		}
+		return nil, fmt.Errorf("%w: %v", ErrIndexOutOfRange, index)
+	case []byte:
+		i, err := toInt(index)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= len(x) {
+			return nil, fmt.Errorf("%w: %d with length %d", ErrIndexOutOfRange, i, len(x))
+		}
+		return int64(x[i]), nil
+	}
+
+	v := reflect.ValueOf(x)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, fmt.Errorf("%w: index of nil %s", ErrTypeMismatch, v.Type())
+		}
+		v = v.Elem()
+	}
+	if isByteSlice(v) {
+		return indexValue(v.Bytes(), index)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return indexValue(v.String(), index)
+	case reflect.Slice, reflect.Array:
+		i, err := toInt(index)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= v.Len() {
+			return nil, fmt.Errorf("%w: %d with length %d", ErrIndexOutOfRange, i, v.Len())
+		}
+		return fromGo(v.Index(i)), nil
+	case reflect.Map:
+		key, err := convertKey(reflect.ValueOf(index), v.Type().Key())
+		if err != nil {
+			return nil, err
+		}
+		val := v.MapIndex(key)
+		if !val.IsValid() {
+			return nil, fmt.Errorf("%w: %#v", ErrMissingKey, index)
+		}
+		return fromGo(val), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported type for index %T[%T]", ErrTypeMismatch, x, index)
+}
+
+// maxRangeLength limits how many values iterating over a Range can produce.
+const maxRangeLength = 10000
+
+// iterate calls fn with each element of a slice or array, each key of a
+// map, or each int64 in a Range, until fn returns true to stop. Like
+// indexValue, elements are converted with fromGo, and []byte elements are
+// int64s.
+func iterate(x any, fn func(elem any) (stop bool, err error)) error {
+	if r, ok := x.(Range); ok {
+		start, ok := r.Start.(int64)
+		if !ok {
+			return fmt.Errorf("%w: unsupported type for iteration range of %T", ErrTypeMismatch, r.Start)
+		}
+		end, ok := r.End.(int64)
+		if !ok {
+			return fmt.Errorf("%w: unsupported type for iteration range of %T", ErrTypeMismatch, r.End)
+		}
+		if r.Exclusive {
+			if end == math.MinInt64 {
+				return nil
+			}
+			end--
+		}
+		if end >= start && uint64(end)-uint64(start) >= maxRangeLength {
+			return fmt.Errorf("%w: range %d..%d longer than %d", ErrValueMismatch, start, end, maxRangeLength)
+		}
+		for i := start; i <= end; i++ {
+			stop, err := fn(i)
+			if err != nil || stop || i == math.MaxInt64 {
+				return err
+			}
+		}
+		return nil
+	}
+	if b, ok := x.([]byte); ok {
+		for _, elem := range b {
+			stop, err := fn(int64(elem))
+			if err != nil || stop {
+				return err
+			}
+		}
+		return nil
+	}
+	v := reflect.ValueOf(x)
+	if isByteSlice(v) {
+		return iterate(v.Bytes(), fn)
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			stop, err := fn(fromGo(v.Index(i)))
+			if err != nil || stop {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			stop, err := fn(fromGo(iter.Key()))
+			if err != nil || stop {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unsupported type for iteration %T", ErrTypeMismatch, x)
+}
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	funcType  = reflect.TypeOf(Func(nil))
+)
+
+// callArg prepares arg to be the i'th argument to a function of type ft.
+func callArg(ft reflect.Type, i int, arg any) (reflect.Value, error) {
+	var paramType reflect.Type
+	switch {
+	case ft.IsVariadic() && i >= ft.NumIn()-1:
+		paramType = ft.In(ft.NumIn() - 1).Elem()
+	case i < ft.NumIn():
+		paramType = ft.In(i)
+	}
+	if fn, ok := arg.(Func); ok && paramType != nil &&
+		paramType.Kind() == reflect.Func && paramType != funcType {
+		if paramType.NumOut() == 0 || paramType.Out(paramType.NumOut()-1) != errorType {
+			return reflect.Value{}, fmt.Errorf("%w: lambda argument %d for %s, which can't return an error", ErrTypeMismatch, i, paramType)
+		}
+		return adaptFunc(fn, paramType), nil
+	}
+	if arg == nil && paramType != nil {
+		if !nillable(paramType.Kind()) {
+			return reflect.Value{}, fmt.Errorf("%w: null argument %d for %s", ErrTypeMismatch, i, paramType)
+		}
+		return reflect.Zero(paramType), nil
+	}
+	return reflect.ValueOf(arg), nil
+}
+
+// adaptFunc wraps fn in a func of type ft, so it can be passed to Go code
+// expecting that type. ft's last result must be an error, which is how
+// the Go code learns about anything going wrong in fn, even if it calls
+// the func long after the call it was passed to has returned.
+func adaptFunc(fn Func, ft reflect.Type) reflect.Value {
+	return reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+		args := make([]any, 0, len(in))
+		for i, arg := range in {
+			if ft.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < arg.Len(); j++ {
+					args = append(args, fromGo(arg.Index(j)))
+				}
+				continue
+			}
+			args = append(args, fromGo(arg))
+		}
+		res, err := fn(args...)
+
+		out := make([]reflect.Value, ft.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(ft.Out(i))
+		}
+		if err == nil && len(out) > 1 {
+			out[0], err = convertResult(res, ft.Out(0))
+		}
+		if err != nil {
+			out[0] = reflect.Zero(ft.Out(0))
+			out[len(out)-1] = reflect.ValueOf(&err).Elem()
+		}
+		return out
+	})
+}
+
+// convertResult converts res to type t, for returning from an adapted
+// Func.
+func convertResult(res any, t reflect.Type) (reflect.Value, error) {
+	v := reflect.ValueOf(res)
+	switch {
+	case !v.IsValid() && nillable(t.Kind()):
+		return reflect.Zero(t), nil
+	case !v.IsValid():
+	case v.Type().AssignableTo(t):
+		rv := reflect.New(t).Elem()
+		rv.Set(v)
+		return rv, nil
+	case kindClass(v.Kind()) != "" && kindClass(v.Kind()) == kindClass(t.Kind()):
+		return v.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("%w: lambda returned %T, expected %s", ErrTypeMismatch, res, t)
+}